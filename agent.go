@@ -1,53 +1,167 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dhx71/hub/hublib"
-"github.com/google/uuid"
+	"github.com/google/uuid"
 	"github.com/tebeka/atexit"
 )
 
 type agentRequest struct {
 	Type, Destination, Refid string
+	Listen                   string   // interface the agent listens on for createReverseTunnel
+	PublicKey                string   // client key pair to encrypt the tunnel room end-to-end
+	Agent                    string   // name of the agent that must answer. Any agent when empty
+	Command                  []string // program and arguments to run for runCommand
+	Rows, Cols               int      // terminal size, in startShell
+	Term                     string   // terminal type, in startShell
+	Path                     string   // agent file to put or get
+	Size, Offset             int64    // file size and where to resume a put or get
+	Checksum                 string   // hex SHA-256 checksum of the file to put
+	Resume                   bool     // client can resume the tunnel after hub disconnections, in createTunnel
 }
 
 type agentResponse struct {
 	Type, Room, Password, Refid, Cause string
 	Success                            bool
+	PublicKey                          string            // agent key pair to encrypt the tunnel room end-to-end
+	Name                               string            // agent name, in agentAnnounce
+	Labels                             map[string]string // agent labels, in agentAnnounce
+	Load                               int               // active tunnels of the agent, in agentAnnounce
+	Data                               []byte            // command output, in stdout and stderr
+	ExitCode                           int               // command exit code, in exit
+	Size, Offset                       int64             // file size and where the transfer resumes
+	Checksum                           string            // hex SHA-256 checksum of the file to get
+	Resume                             bool              // tunnel stream resumes after hub disconnections, in tunnelCreated
 }
 
 func startAgent() {
-	hubClient := hublib.NewClient(*agent, *token, *bypassProxy, *proxy)
-	controlRoom, err := hubClient.Join(*room, *password)
+	if len(*policyFile) > 0 {
+		var err error
+		agentPolicy, err = loadPolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("agent | failed to load policy file %s. %s", *policyFile, err)
+		}
+	}
+	name := *agentName
+	if len(name) == 0 {
+		name, _ = os.Hostname()
+	}
+	labels, err := parseLabels(*agentLabels)
+	if err != nil {
+		log.Fatal("agent | ", err)
+	}
+	announcement := func(refid string) agentResponse {
+		return agentResponse{
+			Type:   "agentAnnounce",
+			Refid:  refid,
+			Name:   name,
+			Labels: labels,
+			Load:   int(atomic.LoadInt64(&activeTunnels))}
+	}
+	for _, program := range strings.Split(*allowExec, ",") {
+		if program = strings.TrimSpace(program); len(program) > 0 {
+			allowedCommands[program] = true
+		}
+	}
+	hubClient := newHubClient(*agent)
+	// clients learn about the agent each time it joins the room
+	join := func() (*hublib.ResilientRoom, error) {
+		return joinControlRoom(hubClient, func(controlRoom *hublib.Room) error {
+			return controlRoom.WriteJSON(announcement(""))
+		})
+	}
+	controlRoom, err := join()
 	if err != nil {
-		log.Fatal("agent | failed to join room. ", *room)
+		log.Fatal("agent | failed to join room. ", *room, err)
 	}
+	log.Println("agent | joined room", *room, "as agent", name, labels)
+	for {
+		serveAgentRequests(hubClient, controlRoom, name, announcement)
+		// the hub refused to let the agent in again, it may accept it later
+		for {
+			log.Println("agent | lost room", *room, "joining it again in", controlRoomRejoinDelay)
+			time.Sleep(controlRoomRejoinDelay)
+			controlRoom, err = join()
+			if err == nil {
+				break
+			}
+			log.Println("agent | failed to join room", *room, err)
+		}
+	}
+}
+
+// serveAgentRequests handles the requests clients send to agent name through
+// controlRoom until the room is closed. announcement returns the message
+// telling clients about the agent.
+func serveAgentRequests(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, name string, announcement func(refid string) agentResponse) {
 	defer controlRoom.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(agentAnnounceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				controlRoom.WriteJSON(announcement(""))
+			case <-done:
+				return
+			}
+		}
+	}()
 	for {
 		var req agentRequest
 		err := controlRoom.ReadJSON(&req)
 		if err != nil {
 			log.Println("agent | failed to read JSON from room", *room, err)
-			if err.Error() == "websocket: close 1006 (abnormal closure): unexpected EOF" {
-				controlRoom, err = hubClient.Join(*room, *password)
-				if err != nil {
-					log.Fatal("agent | failed to join room. ", *room)
-				}
+			if controlRoom.State() == hublib.RoomClosed {
+				return
 			}
 			continue
 		}
+		if len(req.Agent) > 0 && req.Agent != name {
+			continue
+		}
 		log.Printf("agent | got message on room %s: %v\n", *room, req)
-		if req.Type == "createTunnel" {
-			createTunnel(hubClient, controlRoom, req.Destination, req.Refid)
+		if req.Type == "discoverAgents" {
+			controlRoom.WriteJSON(announcement(req.Refid))
+		} else if req.Type == "createTunnel" {
+			go createTunnel(hubClient, controlRoom, req.Destination, req.Refid, req.PublicKey, req.Resume)
+		} else if req.Type == "createUDPTunnel" {
+			go createUDPTunnel(hubClient, controlRoom, req.Destination, req.Refid, req.PublicKey)
+		} else if req.Type == "createMuxSession" {
+			go createMuxSession(hubClient, controlRoom, req.Refid, req.PublicKey)
+		} else if req.Type == "createReverseTunnel" || req.Type == "renewReverseTunnel" {
+			go createReverseTunnel(hubClient, controlRoom, req.Listen, req.Refid, req.PublicKey, req.Type == "renewReverseTunnel")
+		} else if req.Type == "closeReverseTunnel" {
+			if closeReverseTunnel(req.Listen, req.Refid) {
+				log.Println("agent | reverse tunnel on", req.Listen, "closed by its client")
+			}
+		} else if req.Type == "runCommand" {
+			go runCommand(hubClient, controlRoom, req.Command, req.Refid, req.PublicKey)
+		} else if req.Type == "createShell" {
+			go createShell(hubClient, controlRoom, req.Refid, req.PublicKey)
+		} else if req.Type == "put" {
+			go receiveFile(hubClient, controlRoom, req)
+		} else if req.Type == "get" {
+			go sendFile(hubClient, controlRoom, req)
 		}
 	}
 
 }
 
-func createTunnel(hubClient *hublib.Client, controlRoom *hublib.Room, destination, refid string) {
+func createTunnel(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, destination, refid, peerPublic string, resume bool) {
+	// tunnels close on disconnection when either side disabled resumption
+	resume = resume && *resumeTimeout > 0
 	tunnelRoom := uuid.New().String()
 	tunnelPassword := uuid.New().String()
 
@@ -59,7 +173,8 @@ func createTunnel(hubClient *hublib.Client, controlRoom *hublib.Room, destinatio
 			Success: false})
 	}
 	var tcpConn net.Conn = nil
-	roomConn, err := hubClient.Join(tunnelRoom, tunnelPassword)
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, tunnelRoom, tunnelPassword, kp, peerPublic, false)
 	if err != nil {
 		log.Println(tunnelRoom, "agent | failed to create room for tunnel")
 		returnFailure("failed to create room for tunnel")
@@ -74,27 +189,28 @@ func createTunnel(hubClient *hublib.Client, controlRoom *hublib.Room, destinatio
 			atexit.Exit(0)
 		}
 	}
-	log.Println("agent |", tunnelRoom, "opening connection to", destination)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", destination)
+	ips, err := checkDestination(destination)
 	if err != nil {
-		log.Println("agent | failed to resolve destination address", destination, err.Error())
-		returnFailure("failed to resolve destination address")
+		log.Println("agent |", tunnelRoom, err)
+		returnFailure(err.Error())
 		doClose()
 		return
 	}
-
-	tcpConn, err = net.DialTCP("tcp", nil, tcpAddr)
+	log.Println("agent |", tunnelRoom, "opening connection to", destination)
+	tcpConn, err = dialDestination("tcp", destination, ips)
 	if err != nil {
-		log.Println("agent |", tunnelRoom, "Destination dial failed", tcpAddr, err.Error())
+		log.Println("agent |", tunnelRoom, "Destination dial failed", destination, err.Error())
 		returnFailure("failed to dial destination")
 		doClose()
 		return
 	}
 	err = controlRoom.WriteJSON(agentResponse{
-		Type:     "tunnelCreated",
-		Refid:    refid,
-		Room:     tunnelRoom,
-		Password: tunnelPassword})
+		Type:      "tunnelCreated",
+		Refid:     refid,
+		Room:      tunnelRoom,
+		Password:  tunnelPassword,
+		PublicKey: publicKey(kp),
+		Resume:    resume})
 	if err != nil {
 		log.Println("agent |", tunnelRoom, "Failed to send tunnelCreated message back to client")
 		doClose()
@@ -102,9 +218,319 @@ func createTunnel(hubClient *hublib.Client, controlRoom *hublib.Room, destinatio
 	}
 
 	go func() {
-		roomConn.Relay(tcpConn)
+		defer trackTunnel()()
+		var timeout time.Duration
+		if resume {
+			timeout = *resumeTimeout
+		}
+		relayTunnel(hubClient, roomConn, tcpConn, timeout)
 		if *exitOnDisconnect {
 			os.Exit(0)
 		}
 	}()
 }
+
+// createUDPTunnel relays datagrams between a new tunnel room and destination.
+func createUDPTunnel(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, destination, refid, peerPublic string) {
+	tunnelRoom := uuid.New().String()
+	tunnelPassword := uuid.New().String()
+
+	returnFailure := func(cause string) {
+		controlRoom.WriteJSON(agentResponse{
+			Type:    "tunnelCreationFailed",
+			Refid:   refid,
+			Cause:   cause,
+			Success: false})
+	}
+	ips, err := checkDestination(destination)
+	if err != nil {
+		log.Println("agent |", err)
+		returnFailure(err.Error())
+		return
+	}
+	conn, err := dialDestination("udp", destination, ips)
+	if err != nil {
+		log.Println("agent |", tunnelRoom, "udp destination dial failed", destination, err.Error())
+		returnFailure("failed to dial destination")
+		return
+	}
+	udpConn := conn.(*net.UDPConn)
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, tunnelRoom, tunnelPassword, kp, peerPublic, false)
+	if err != nil {
+		log.Println(tunnelRoom, "agent | failed to create room for udp tunnel")
+		returnFailure("failed to create room for tunnel")
+		udpConn.Close()
+		return
+	}
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "tunnelCreated",
+		Refid:     refid,
+		Room:      tunnelRoom,
+		Password:  tunnelPassword,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", tunnelRoom, "Failed to send tunnelCreated message back to client")
+		roomConn.Close()
+		udpConn.Close()
+		return
+	}
+	log.Println("agent |", tunnelRoom, "relaying udp datagrams with", destination)
+	go func() {
+		defer trackTunnel()()
+		roomConn.RelayUDP(udpConn, *udpTimeout)
+	}()
+}
+
+func createMuxSession(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, refid, peerPublic string) {
+	sessionRoom := uuid.New().String()
+	sessionPassword := uuid.New().String()
+
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, sessionRoom, sessionPassword, kp, peerPublic, false)
+	if err != nil {
+		log.Println(sessionRoom, "agent | failed to create room for multiplexed session")
+		controlRoom.WriteJSON(agentResponse{
+			Type:    "muxSessionCreationFailed",
+			Refid:   refid,
+			Cause:   "failed to create room for multiplexed session",
+			Success: false})
+		return
+	}
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "muxSessionCreated",
+		Refid:     refid,
+		Room:      sessionRoom,
+		Password:  sessionPassword,
+		Success:   true,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", sessionRoom, "Failed to send muxSessionCreated message back to client")
+		roomConn.Close()
+		return
+	}
+
+	session := hublib.NewSession(roomConn, false)
+	go func() {
+		defer session.Close()
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				log.Println("agent |", sessionRoom, "multiplexed session closed.", err)
+				return
+			}
+			go serveStream(stream)
+		}
+	}()
+}
+
+func serveStream(stream *hublib.Stream) {
+	destination := stream.Target()
+	ips, err := checkDestination(destination)
+	if err != nil {
+		log.Println("agent |", err)
+		stream.Reject(err.Error())
+		return
+	}
+	log.Println("agent | opening stream connection to", destination)
+	tcpConn, err := dialDestination("tcp", destination, ips)
+	if err != nil {
+		log.Println("agent | Destination dial failed", destination, err.Error())
+		stream.Reject("failed to dial destination")
+		return
+	}
+	err = stream.Ack()
+	if err != nil {
+		tcpConn.Close()
+		return
+	}
+	defer trackTunnel()()
+	hublib.Pipe(stream, tcpConn)
+	if *exitOnDisconnect {
+		atexit.Exit(0)
+	}
+}
+
+// Reverse tunnels are leased: the client renews its request every
+// reverseLeaseInterval and the agent stops listening when it was not
+// renewed for reverseLeaseTimeout, or when the client cancels it.
+const (
+	reverseLeaseInterval = 30 * time.Second
+	reverseLeaseTimeout  = 3 * reverseLeaseInterval
+)
+
+// reverseTunnel is a listener opened by the agent on behalf of a client.
+type reverseTunnel struct {
+	listener    net.Listener
+	controlRoom *hublib.ResilientRoom
+	refid       string
+	peerPublic  string    // client public key to encrypt each connection room
+	renewed     time.Time // last request of the client
+}
+
+var (
+	reverseTunnels     = make(map[string]*reverseTunnel)
+	reverseTunnelsLock = sync.Mutex{}
+)
+
+// createReverseTunnel listens on listenIf and, for each accepted connection,
+// creates a tunnel room the client joins to relay it to its destination.
+// The client asking again for the same interface renews its lease. Other
+// clients may only take the listener over once the lease expired. Renewals
+// are not answered.
+func createReverseTunnel(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, listenIf, refid, peerPublic string, renewal bool) {
+	returnFailure := func(cause string) {
+		controlRoom.WriteJSON(agentResponse{
+			Type:    "reverseTunnelCreationFailed",
+			Refid:   refid,
+			Cause:   cause,
+			Success: false})
+	}
+	listenAddr, err := checkListen(listenIf)
+	if err != nil {
+		log.Println("agent |", err)
+		returnFailure(err.Error())
+		return
+	}
+	reverseTunnelsLock.Lock()
+	defer reverseTunnelsLock.Unlock()
+	if rt, found := reverseTunnels[listenIf]; found {
+		if rt.refid != refid {
+			if renewal {
+				// another client took the listener over
+				return
+			}
+			if time.Since(rt.renewed) <= reverseLeaseTimeout {
+				log.Println("agent | refusing reverse tunnel on", listenIf, "leased to request", rt.refid)
+				returnFailure(listenIf + " is used by another reverse tunnel")
+				return
+			}
+			log.Println("agent | reverse tunnel on", listenIf, "taken over by request", refid, "after its lease expired")
+		}
+		rt.controlRoom, rt.refid, rt.peerPublic, rt.renewed = controlRoom, refid, peerPublic, time.Now()
+		if !renewal {
+			controlRoom.WriteJSON(agentResponse{
+				Type:    "reverseTunnelCreated",
+				Refid:   refid,
+				Success: true})
+		}
+		return
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Println("agent | failed to listen on", listenIf, err)
+		returnFailure("failed to listen on " + listenIf)
+		return
+	}
+	log.Println("agent | listening for reverse tunnel connections on", listenIf)
+	rt := &reverseTunnel{listener, controlRoom, refid, peerPublic, time.Now()}
+	reverseTunnels[listenIf] = rt
+	controlRoom.WriteJSON(agentResponse{
+		Type:    "reverseTunnelCreated",
+		Refid:   refid,
+		Success: true})
+
+	go expireReverseTunnel(listenIf, rt)
+	go func() {
+		var delay time.Duration
+		for {
+			tcpConn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("agent | stopped listening for reverse tunnel connections on", listenIf)
+				return
+			}
+			if err != nil {
+				// running out of file descriptors lasts a while, wait before retrying
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Println("agent | failed to accept reverse tunnel connection. Retrying in", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			reverseTunnelsLock.Lock()
+			controlRoom, refid, peerPublic := rt.controlRoom, rt.refid, rt.peerPublic
+			reverseTunnelsLock.Unlock()
+			go relayReverseConnection(hubClient, controlRoom, refid, peerPublic, tcpConn)
+		}
+	}()
+}
+
+// expireReverseTunnel closes rt once its client stopped renewing it.
+func expireReverseTunnel(listenIf string, rt *reverseTunnel) {
+	ticker := time.NewTicker(reverseLeaseInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reverseTunnelsLock.Lock()
+		current, expired := reverseTunnels[listenIf] == rt, time.Since(rt.renewed) > reverseLeaseTimeout
+		reverseTunnelsLock.Unlock()
+		if !current {
+			return
+		}
+		if expired {
+			log.Println("agent | reverse tunnel on", listenIf, "was not renewed by its client")
+			closeReverseTunnel(listenIf, rt.refid)
+			return
+		}
+	}
+}
+
+// closeReverseTunnel stops listening on listenIf when the reverse tunnel
+// there was requested by refid. Connections already relayed go on.
+func closeReverseTunnel(listenIf, refid string) bool {
+	reverseTunnelsLock.Lock()
+	defer reverseTunnelsLock.Unlock()
+	rt, found := reverseTunnels[listenIf]
+	if !found || rt.refid != refid {
+		return false
+	}
+	delete(reverseTunnels, listenIf)
+	rt.listener.Close()
+	return true
+}
+
+func relayReverseConnection(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, refid, peerPublic string, tcpConn net.Conn) {
+	log.Println("agent | got reverse tunnel connection from", tcpConn.RemoteAddr())
+	tunnelRoom := uuid.New().String()
+	tunnelPassword := uuid.New().String()
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, tunnelRoom, tunnelPassword, kp, peerPublic, false)
+	if err != nil {
+		log.Println("agent |", tunnelRoom, "failed to create room for reverse tunnel", err)
+		tcpConn.Close()
+		return
+	}
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "reverseConnection",
+		Refid:     refid,
+		Room:      tunnelRoom,
+		Password:  tunnelPassword,
+		Success:   true,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", tunnelRoom, "Failed to send reverseConnection message to client")
+		roomConn.Close()
+		tcpConn.Close()
+		return
+	}
+	// wait for the client to join and reach its destination so no data is
+	// relayed to an empty room
+	timer := time.AfterFunc(30*time.Second, func() { roomConn.Close() })
+	var ready agentResponse
+	err = roomConn.ReadJSON(&ready)
+	timer.Stop()
+	if err != nil || ready.Type != "reverseConnectionReady" {
+		log.Println("agent |", tunnelRoom, "client failed to handle reverse connection.", err, ready.Cause)
+		roomConn.Close()
+		tcpConn.Close()
+		return
+	}
+	defer trackTunnel()()
+	roomConn.Relay(tcpConn)
+	if *exitOnDisconnect {
+		atexit.Exit(0)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// agentAnnounceInterval is how often agents tell clients they are alive and how loaded.
+	agentAnnounceInterval = 30 * time.Second
+	// agentExpiry is how long clients keep using an agent that stopped announcing itself.
+	agentExpiry = 3 * agentAnnounceInterval
+)
+
+// activeTunnels is the number of tunnels the agent is relaying, announced as its load.
+var activeTunnels int64
+
+// trackTunnel counts a tunnel as active until the returned func is called.
+func trackTunnel() func() {
+	atomic.AddInt64(&activeTunnels, 1)
+	return func() { atomic.AddInt64(&activeTunnels, -1) }
+}
+
+// parseLabels parses comma separated key=value labels.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, fmt.Errorf("invalid label %q. Expecting key=value", field)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// knownAgent is an agent seen announcing itself in the control room.
+type knownAgent struct {
+	labels map[string]string
+	load   int
+	seen   time.Time
+}
+
+// agentSelector picks the agent a client sends its requests to among the
+// agents announced in the control room.
+type agentSelector struct {
+	name        string            // only agent to use when not empty
+	labels      map[string]string // labels the agents must have
+	leastLoaded bool              // round-robin otherwise
+
+	lock   sync.Mutex // protects the fields below
+	agents map[string]*knownAgent
+	next   int
+	// discoverUntil is when agents should have answered a discovery request
+	discoverUntil time.Time
+	// announced is closed and replaced whenever an agent announces itself
+	announced chan struct{}
+}
+
+func newAgentSelector(name, labels, mode string) (*agentSelector, error) {
+	selector := &agentSelector{
+		name:      name,
+		agents:    make(map[string]*knownAgent),
+		announced: make(chan struct{}),
+	}
+	var err error
+	selector.labels, err = parseLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case "round-robin", "":
+	case "least-loaded":
+		selector.leastLoaded = true
+	default:
+		return nil, fmt.Errorf("invalid agent selection %q. Expecting round-robin or least-loaded", mode)
+	}
+	return selector, nil
+}
+
+// update records an agent announcement.
+func (selector *agentSelector) update(resp agentResponse) {
+	if len(resp.Name) == 0 {
+		return
+	}
+	selector.lock.Lock()
+	defer selector.lock.Unlock()
+	selector.agents[resp.Name] = &knownAgent{labels: resp.Labels, load: resp.Load, seen: time.Now()}
+	close(selector.announced)
+	selector.announced = make(chan struct{})
+}
+
+// discovering lets pick wait for agents to answer a discovery request for up to d.
+func (selector *agentSelector) discovering(d time.Duration) {
+	selector.lock.Lock()
+	selector.discoverUntil = time.Now().Add(d)
+	selector.lock.Unlock()
+}
+
+// sent accounts for a request sent to agent until it announces its load again.
+func (selector *agentSelector) sent(agent string) {
+	selector.lock.Lock()
+	defer selector.lock.Unlock()
+	if known, found := selector.agents[agent]; found {
+		known.load++
+	}
+}
+
+// pick returns the agent to send the next request to, waiting up to wait
+// for a matching agent. It returns "" when no particular agent is required
+// and none announced itself during discovery, so requests are answered by
+// any agent, including those too old to announce themselves.
+func (selector *agentSelector) pick(wait time.Duration) (string, error) {
+	deadline := time.After(wait)
+	for {
+		selector.lock.Lock()
+		candidates := selector.candidates()
+		if len(candidates) > 0 {
+			defer selector.lock.Unlock()
+			if selector.leastLoaded {
+				best := candidates[0]
+				for _, name := range candidates[1:] {
+					if selector.agents[name].load < selector.agents[best].load {
+						best = name
+					}
+				}
+				return best, nil
+			}
+			selector.next++
+			return candidates[selector.next%len(candidates)], nil
+		}
+		announced := selector.announced
+		discovery := time.Until(selector.discoverUntil)
+		selector.lock.Unlock()
+		if len(selector.name) == 0 && len(selector.labels) == 0 {
+			if discovery <= 0 {
+				return "", nil
+			}
+			select {
+			case <-announced:
+			case <-time.After(discovery):
+			}
+			continue
+		}
+		select {
+		case <-announced:
+		case <-deadline:
+			if len(selector.name) > 0 {
+				return "", fmt.Errorf("agent %s did not announce itself in room %s", selector.name, *room)
+			}
+			return "", fmt.Errorf("no agent with labels %v announced itself in room %s", selector.labels, *room)
+		}
+	}
+}
+
+// candidates returns the sorted names of the live agents matching the
+// selector. selector.lock must be held.
+func (selector *agentSelector) candidates() []string {
+	var names []string
+	for name, known := range selector.agents {
+		if time.Since(known.seen) > agentExpiry {
+			continue
+		}
+		if len(selector.name) > 0 && name != selector.name {
+			continue
+		}
+		matches := true
+		for k, v := range selector.labels {
+			if known.labels[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
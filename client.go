@@ -1,23 +1,88 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-"github.com/dhx71/hub/hublib"
+	"github.com/dhx71/hub/hublib"
 	"github.com/google/uuid"
 	"github.com/tebeka/atexit"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 type tunnelInfo struct {
 	Listen, Destination string
+	// Reverse makes the agent listen on Listen and relay connections to
+	// Destination reachable from the client.
+	Reverse bool
+	// UDP relays datagrams instead of tcp connections.
+	UDP bool
+}
+
+// udpFlow relays the datagrams coming from one source address through a
+// tunnel of its own.
+type udpFlow struct {
+	datagrams  chan []byte   // waiting to be written to the tunnel
+	done       chan struct{} // closed with the flow
+	lastActive int64         // unix nano, accessed atomically
+	lock       sync.Mutex    // protects the fields below
+	tunnel     *hublib.Room  // nil until the agent created it
+	closed     bool
+}
+
+func newUDPFlow() *udpFlow {
+	return &udpFlow{
+		datagrams:  make(chan []byte, 64),
+		done:       make(chan struct{}),
+		lastActive: time.Now().UnixNano()}
+}
+
+func (flow *udpFlow) touch() {
+	atomic.StoreInt64(&flow.lastActive, time.Now().UnixNano())
+}
+
+func (flow *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&flow.lastActive)))
+}
+
+// setTunnel gives the flow its tunnel. It returns false, closing the
+// tunnel, when the flow was closed while the tunnel was created.
+func (flow *udpFlow) setTunnel(tunnel *hublib.Room) bool {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if flow.closed {
+		tunnel.Close()
+		return false
+	}
+	flow.tunnel = tunnel
+	return true
+}
+
+func (flow *udpFlow) close() {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if flow.closed {
+		return
+	}
+	flow.closed = true
+	close(flow.done)
+	if flow.tunnel != nil {
+		flow.tunnel.Close()
+	}
 }
 
 type clientConfig struct {
@@ -106,72 +171,389 @@ func getHost(hostPort string) string {
 	return hp[0]
 }
 
-func startClient() {
-	log.Println("client| starting client and connecting to", *client)
-	hubClient := hublib.NewClient(*client, *token, *bypassProxy, *proxy)
-	var controlRoom *hublib.Room
-	enterControlRoom := func() {
-		var err error
-		controlRoom, err = hubClient.Join(*room, *password)
-		if err != nil {
-			log.Fatal("client| failed to join room ", *room, err)
-		}
+// clientOptions tells startClient which hub to connect to and what to do
+// through its agents. main fills it from the command line. The room, its
+// password, end-to-end encryption and the hub TLS settings are shared with
+// the agent and stay in their flags.
+type clientOptions struct {
+	hub                      string
+	agentName, agentLabels   string // agents to send requests to
+	agentSelect              string // how to pick among them
+	agentTimeout             time.Duration
+	resumeTimeout            time.Duration // 0 when tunnels close on hub disconnections
+	udpTimeout               time.Duration
+	exitOnDisconnect         bool
+	listen                   string // local address of -tunnel, -udp and -rdp tunnels
+	tunnel, reverse          string
+	udp                      bool
+	rdp                      string
+	tunnelsFile              string
+	socks5, httpProxy        string
+	multiplex                bool
+	controlAPI, controlToken string
+	execCommand              string
+	shell                    bool
+	putFile, getFile         string
+	args                     []string // command line arguments left after the flags
+}
+
+func startClient(opts clientOptions) {
+	log.Println("client| starting client and connecting to", opts.hub)
+	hubClient := newHubClient(opts.hub)
+	selector, err := newAgentSelector(opts.agentName, opts.agentLabels, opts.agentSelect)
+	if err != nil {
+		log.Fatal("client| ", err)
+	}
+	// agents present in the room answer with their name and labels
+	selector.discovering(2 * time.Second)
+	controlRoom, err := joinControlRoom(hubClient, func(controlRoom *hublib.Room) error {
+		return controlRoom.WriteJSON(&agentRequest{Type: "discoverAgents"})
+	})
+	if err != nil {
+		log.Fatal("client| failed to join room ", *room, err)
 	}
-	enterControlRoom()
 	defer func() {
 		controlRoom.Close()
 	}()
+	dispatcher := newControlDispatcher(controlRoom, selector)
 
-	createOneTunnel := func(listenIf, destination string) {
-		log.Println("client| listening for tcp/ip connection on", listenIf)
-		listener, err := net.Listen("tcp", listenIf)
+	var session *hublib.Session
+	sessionLock := sync.Mutex{}
+	// getSession returns the multiplexed session shared by all tunnels,
+	// asking the agent for a new one when there is none or it was closed.
+	getSession := func() (*hublib.Session, error) {
+		sessionLock.Lock()
+		defer sessionLock.Unlock()
+		if session != nil && session.Err() == nil {
+			return session, nil
+		}
+		kp := newE2EKeyPair()
+		resp, err := dispatcher.request(agentRequest{
+			Type:      "createMuxSession",
+			PublicKey: publicKey(kp)}, opts.agentTimeout)
 		if err != nil {
-			log.Fatal("client| failed to listen on", listenIf, err)
+			return nil, err
+		}
+		if resp.Type != "muxSessionCreated" {
+			return nil, fmt.Errorf("multiplexed session creation failed. cause: %s", resp.Cause)
+		}
+		roomConn, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to join multiplexed session room. %s", err)
+		}
+		log.Println("client| joined multiplexed session room", resp.Room)
+		session = hublib.NewSession(roomConn, true)
+		return session, nil
+	}
+
+	// openTunnelRoom asks the agent for the tunnel described by req and joins its room.
+	openTunnelRoom := func(req agentRequest) (*hublib.Room, agentResponse, error) {
+		kp := newE2EKeyPair()
+		req.PublicKey = publicKey(kp)
+		resp, err := dispatcher.request(req, opts.agentTimeout)
+		if err != nil {
+			return nil, resp, err
+		}
+		if resp.Type != "tunnelCreated" {
+			return nil, resp, fmt.Errorf("tunnel creation failed. cause: %s", resp.Cause)
+		}
+		tunnel, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+		return tunnel, resp, err
+	}
+
+	// openTCPTunnel opens a tunnel to destination and returns the function
+	// relaying a connection through it.
+	openTCPTunnel := func(destination string) (func(net.Conn), error) {
+		tunnel, resp, err := openTunnelRoom(agentRequest{
+			Type:        "createTunnel",
+			Destination: destination,
+			Resume:      opts.resumeTimeout > 0})
+		if err != nil {
+			return nil, err
+		}
+		return func(conn net.Conn) {
+			defer conn.Close()
+			var timeout time.Duration
+			if resp.Resume {
+				timeout = opts.resumeTimeout
+			}
+			relayTunnel(hubClient, tunnel, conn, timeout)
+		}, nil
+	}
+
+	// serveTunnel relays each connection accepted by tunnel until it is closed.
+	serveTunnel := func(tunnel *localTunnel) {
+		listenIf, destination := tunnel.listen, tunnel.destination
+
+		handleMuxConn := func(tcpConn net.Conn) {
+			session, err := getSession()
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), err)
+				tcpConn.Close()
+				return
+			}
+			stream, err := session.Open(destination)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), "failed to open stream.", err)
+				tcpConn.Close()
+				return
+			}
+			log.Println("client|", tcpConn.RemoteAddr(), "Opened stream. Now relaying data with", listenIf)
+			hublib.Pipe(stream, tcpConn)
+			if opts.exitOnDisconnect {
+				atexit.Exit(0)
+			}
 		}
 
 		handleConn := func(tcpConn net.Conn) {
 			log.Println("client| got connection from", tcpConn.RemoteAddr())
-			refid := uuid.New().String()
-			err := controlRoom.WriteJSON(&agentRequest{
-				Type:        "createTunnel",
-				Destination: destination,
-				Refid:       refid})
-			if err != nil {
-				log.Println("client|", tcpConn.RemoteAddr(), "Failed to send createTunnel message.", err)
-				if err.Error() == "websocket: close sent" {
-					enterControlRoom()
-				}
+			if opts.multiplex {
+				handleMuxConn(tcpConn)
 				return
 			}
-			var resp agentResponse
-			err = controlRoom.ReadJSON(&resp)
+			relay, err := openTCPTunnel(destination)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), err)
+				tcpConn.Close()
+				return
+			}
+			log.Println("client|", tcpConn.RemoteAddr(), "Joined tunnel room. Now relaying data with", listenIf)
+			relay(tcpConn)
+			if opts.exitOnDisconnect {
+				atexit.Exit(0)
+			}
+		}
+
+		for {
+			tcpConn, err := tunnel.listener.Accept()
 			if err != nil {
-				log.Println("client|", tcpConn.RemoteAddr(), "failed to read JSON. ", err)
-				if err.Error() == "websocket: close 1006 (abnormal closure): unexpected EOF" {
-					enterControlRoom()
+				if tunnel.isClosed() {
+					log.Println("client| stopped listening on", listenIf)
+					return
+				}
+				log.Println("client| failed to accept connection.", err)
+				continue
+			}
+			go func() {
+				conn := tunnel.track(tcpConn)
+				defer tunnel.untrack(conn)
+				handleConn(conn)
+			}()
+		}
+	}
+	tunnels := newTunnelRegistry(serveTunnel)
+
+	createOneTunnel := func(listenIf, destination string) {
+		log.Println("client| listening for tcp/ip connection on", listenIf)
+		tunnel, err := tunnels.open(listenIf, destination)
+		if err != nil {
+			log.Fatal("client| failed to listen on", listenIf, err)
+		}
+		serveTunnel(tunnel)
+	}
+
+	// createOneUDPTunnel relays datagrams received on listenIf to destination.
+	// Each source address gets its own tunnel room closed after -udp-timeout of inactivity.
+	createOneUDPTunnel := func(listenIf, destination string) {
+		log.Println("client| listening for udp datagrams on", listenIf)
+		packetConn, err := net.ListenPacket("udp", listenIf)
+		if err != nil {
+			log.Fatal("client| failed to listen on", listenIf, err)
+		}
+		flows := make(map[string]*udpFlow)
+		flowsLock := sync.Mutex{}
+		closeFlow := func(src string, flow *udpFlow) {
+			flowsLock.Lock()
+			if flows[src] == flow {
+				delete(flows, src)
+			}
+			flowsLock.Unlock()
+			flow.close()
+		}
+		go func() {
+			for range time.Tick(opts.udpTimeout / 2) {
+				flowsLock.Lock()
+				for src, flow := range flows {
+					if flow.idle() > opts.udpTimeout {
+						log.Println("client| udp flow from", src, "idle. Closing it")
+						delete(flows, src)
+						flow.close()
+					}
 				}
+				flowsLock.Unlock()
+			}
+		}()
+		// relayFlow creates the tunnel of a new flow and relays its datagrams.
+		// Datagrams of other flows go on while the agent answers.
+		relayFlow := func(src string, srcAddr net.Addr, flow *udpFlow) {
+			tunnel, _, err := openTunnelRoom(agentRequest{Type: "createUDPTunnel", Destination: destination})
+			if err != nil {
+				log.Println("client|", src, err)
+				closeFlow(src, flow)
+				return
+			}
+			if !flow.setTunnel(tunnel) {
 				return
 			}
-			if resp.Refid == refid {
-				if resp.Type == "tunnelCreationFailed" {
-					log.Println("client|", tcpConn.RemoteAddr(), "Tunnel creation failed. cause: %s", resp.Cause)
+			go func() {
+				for {
+					p, err := tunnel.ReadDatagram()
+					if err != nil {
+						log.Println("client| udp flow from", src, "closed.", err)
+						closeFlow(src, flow)
+						return
+					}
+					flow.touch()
+					packetConn.WriteTo(p, srcAddr)
+				}
+			}()
+			for {
+				select {
+				case p := <-flow.datagrams:
+					if err := tunnel.WriteDatagram(p); err != nil {
+						log.Println("client| failed to write datagram from", src, err)
+						closeFlow(src, flow)
+						return
+					}
+				case <-flow.done:
 					return
 				}
-				log.Println("client|", tcpConn.RemoteAddr(), "Tunnel room created")
-				tunnel, err := hubClient.Join(resp.Room, resp.Password)
+			}
+		}
+
+		buf := make([]byte, 65535)
+		for {
+			n, srcAddr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				log.Println("client| failed to read datagram.", err)
+				continue
+			}
+			src := srcAddr.String()
+			flowsLock.Lock()
+			flow, found := flows[src]
+			if !found {
+				log.Println("client| new udp flow from", src)
+				flow = newUDPFlow()
+				flows[src] = flow
+				go relayFlow(src, srcAddr, flow)
+			}
+			flowsLock.Unlock()
+			flow.touch()
+			select {
+			case flow.datagrams <- append([]byte(nil), buf[:n]...):
+			default:
+				log.Println("client| udp flow from", src, "is not keeping up. Dropping datagram")
+			}
+		}
+	}
+
+	// tunnelTo opens a tunnel to destination through the agent, as a stream of
+	// the multiplexed session when -mux is set. The returned function relays
+	// a local connection over the tunnel and closes both when done.
+	tunnelTo := func(destination string) (func(net.Conn), error) {
+		if opts.multiplex {
+			session, err := getSession()
+			if err != nil {
+				return nil, err
+			}
+			stream, err := session.Open(destination)
+			if err != nil {
+				return nil, err
+			}
+			return func(conn net.Conn) { hublib.Pipe(stream, conn) }, nil
+		}
+		return openTCPTunnel(destination)
+	}
+
+	// createSocks5Proxy runs a SOCKS5 server on listenIf. Each CONNECT request
+	// opens a tunnel to the requested destination through the agent.
+	createSocks5Proxy := func(listenIf string) {
+		log.Println("client| listening for socks5 connections on", listenIf)
+		listener, err := net.Listen("tcp", listenIf)
+		if err != nil {
+			log.Fatal("client| failed to listen on", listenIf, err)
+		}
+
+		handleSocks5Conn := func(tcpConn net.Conn) {
+			destination, err := socks5Handshake(tcpConn)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), "socks5 handshake failed.", err)
+				tcpConn.Close()
+				return
+			}
+			log.Println("client|", tcpConn.RemoteAddr(), "socks5 connect to", destination)
+			relay, err := tunnelTo(destination)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), err)
+				socks5Reply(tcpConn, socks5HostUnreach)
+				tcpConn.Close()
+				return
+			}
+			err = socks5Reply(tcpConn, socks5Succeeded)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), "failed to reply to socks5 client.", err)
+			}
+			relay(tcpConn)
+		}
+
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				log.Println("client| failed to accept connection.", err)
+				continue
+			}
+			go handleSocks5Conn(tcpConn)
+		}
+	}
+
+	// createHTTPProxy runs an HTTP proxy on listenIf. CONNECT requests and
+	// absolute-URI requests are forwarded through tunnels opened by the agent.
+	createHTTPProxy := func(listenIf string) {
+		log.Println("client| listening for http proxy connections on", listenIf)
+		listener, err := net.Listen("tcp", listenIf)
+		if err != nil {
+			log.Fatal("client| failed to listen on", listenIf, err)
+		}
+
+		handleProxyConn := func(tcpConn net.Conn) {
+			reader := bufio.NewReader(tcpConn)
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), "failed to read http proxy request.", err)
+				tcpConn.Close()
+				return
+			}
+			destination, err := proxyDestination(req)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), err)
+				writeProxyError(tcpConn, http.StatusBadRequest)
+				tcpConn.Close()
+				return
+			}
+			log.Println("client|", tcpConn.RemoteAddr(), "http proxy", req.Method, "to", destination)
+			relay, err := tunnelTo(destination)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), err)
+				writeProxyError(tcpConn, http.StatusBadGateway)
+				tcpConn.Close()
+				return
+			}
+			if req.Method == http.MethodConnect {
+				_, err = tcpConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 				if err != nil {
-					log.Println("client|", tcpConn.RemoteAddr(), "Failed to join tunnel room")
-					return
+					log.Println("client|", tcpConn.RemoteAddr(), "failed to reply to http proxy client.", err)
 				}
-				log.Println("client|", tcpConn.RemoteAddr(), "Joined room", resp.Room, "Now relaying data with", listenIf)
-				go func() {
-					defer tcpConn.Close()
-					tunnel.Relay(tcpConn)
-					if *exitOnDisconnect {
-						atexit.Exit(0)
-					}
-				}()
+				relay(&prefixedConn{tcpConn, reader})
+				return
 			}
+			first, err := originRequest(req)
+			if err != nil {
+				log.Println("client|", tcpConn.RemoteAddr(), "failed to rewrite http request.", err)
+				writeProxyError(tcpConn, http.StatusBadRequest)
+				tcpConn.Close()
+				return
+			}
+			relay(&prefixedConn{tcpConn, io.MultiReader(bytes.NewReader(first), reader)})
 		}
 
 		for {
@@ -180,7 +562,123 @@ func startClient() {
 				log.Println("client| failed to accept connection.", err)
 				continue
 			}
-			handleConn(tcpConn)
+			go handleProxyConn(tcpConn)
+		}
+	}
+
+	// createOneReverseTunnel asks the agent to listen on agentListenIf and relays
+	// every connection it accepts to destination. It uses its own connection to
+	// the control room so agent notifications are not consumed by other tunnels.
+	createOneReverseTunnel := func(agentListenIf, destination string) {
+		refid := uuid.New().String()
+		kp := newE2EKeyPair()
+		lock := sync.Mutex{} // protects agent and reverseRoom
+		agent := ""
+		var reverseRoom *hublib.ResilientRoom
+		request := func(requestType string) agentRequest {
+			lock.Lock()
+			defer lock.Unlock()
+			return agentRequest{
+				Type:      requestType,
+				Listen:    agentListenIf,
+				Refid:     refid,
+				PublicKey: publicKey(kp),
+				Agent:     agent}
+		}
+		// the request is sent again after each reconnection so the agent
+		// keeps relaying to this client
+		join := func() error {
+			joined, err := joinControlRoom(hubClient, func(controlRoom *hublib.Room) error {
+				picked, err := selector.pick(opts.agentTimeout)
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				agent = picked
+				lock.Unlock()
+				return controlRoom.WriteJSON(request("createReverseTunnel"))
+			})
+			if err == nil {
+				lock.Lock()
+				reverseRoom = joined
+				lock.Unlock()
+			}
+			return err
+		}
+		current := func() *hublib.ResilientRoom {
+			lock.Lock()
+			defer lock.Unlock()
+			return reverseRoom
+		}
+		if err := join(); err != nil {
+			log.Fatal("client| failed to join room ", *room, err)
+		}
+		defer func() { current().Close() }()
+		// the agent stops listening once the client is gone
+		go func() {
+			for range time.Tick(reverseLeaseInterval) {
+				current().WriteJSON(request("renewReverseTunnel"))
+			}
+		}()
+		atexit.Register(func() {
+			current().WriteJSON(request("closeReverseTunnel"))
+		})
+
+		handleReverseConn := func(resp agentResponse) {
+			tunnel, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+			if err != nil {
+				log.Println("client| Failed to join reverse tunnel room", resp.Room, err)
+				return
+			}
+			log.Println("client| reverse connection from", agentListenIf, "opening connection to", destination)
+			tcpConn, err := net.Dial("tcp", destination)
+			if err != nil {
+				log.Println("client| reverse tunnel destination dial failed", destination, err)
+				tunnel.WriteJSON(agentResponse{
+					Type:  "reverseConnectionFailed",
+					Cause: "failed to dial destination"})
+				tunnel.Close()
+				return
+			}
+			err = tunnel.WriteJSON(agentResponse{Type: "reverseConnectionReady", Success: true})
+			if err != nil {
+				tcpConn.Close()
+				tunnel.Close()
+				return
+			}
+			defer tcpConn.Close()
+			tunnel.Relay(tcpConn)
+			if opts.exitOnDisconnect {
+				atexit.Exit(0)
+			}
+		}
+
+		for {
+			var resp agentResponse
+			err := current().ReadJSON(&resp)
+			if err != nil {
+				log.Println("client| failed to read JSON from room", *room, err)
+				// the hub refused to let the client in again, it may accept it later
+				if current().State() == hublib.RoomClosed {
+					log.Println("client| lost room", *room, "joining it again in", controlRoomRejoinDelay)
+					time.Sleep(controlRoomRejoinDelay)
+					if err = join(); err != nil {
+						log.Println("client| failed to join room", *room, err)
+					}
+				}
+				continue
+			}
+			if resp.Refid != refid {
+				continue
+			}
+			switch resp.Type {
+			case "reverseTunnelCreated":
+				log.Println("client| agent listening on", agentListenIf, "for reverse tunnel to", destination)
+			case "reverseTunnelCreationFailed":
+				log.Fatal("client| reverse tunnel creation failed. cause: ", resp.Cause)
+			case "reverseConnection":
+				go handleReverseConn(resp)
+			}
 		}
 	}
 
@@ -190,7 +688,23 @@ func startClient() {
 			atexit.Register(cleanupHostsFileAtExit)
 		}
 		for _, info := range cfg.Tunnels {
+			if info.Reverse {
+				wg.Add(1)
+				go func(info tunnelInfo) {
+					createOneReverseTunnel(info.Listen, info.Destination)
+					wg.Done()
+				}(info)
+				continue
+			}
 			addHostInHostsFile(getHost(info.Listen), getHost(info.Destination))
+			if info.UDP {
+				wg.Add(1)
+				go func(info tunnelInfo) {
+					createOneUDPTunnel(info.Listen, info.Destination)
+					wg.Done()
+				}(info)
+				continue
+			}
 			wg.Add(1)
 			go func(info tunnelInfo) {
 				createOneTunnel(info.Listen, info.Destination)
@@ -202,33 +716,119 @@ func startClient() {
 
 	rand.Seed(time.Now().UnixNano())
 	listenIf := fmt.Sprintf("127.%d.%d.%d:3389", rand.Intn(254), rand.Intn(254), 1+rand.Intn(253))
-	if len(*listen) > 0 {
-		listenIf = *listen
+	if len(opts.listen) > 0 {
+		listenIf = opts.listen
+	}
+
+	if len(opts.controlAPI) > 0 {
+		listener, err := listenControlAPI(opts.controlAPI, opts.controlToken)
+		if err != nil {
+			log.Fatal("client| failed to start control API. ", err)
+		}
+		log.Println("client| serving control API on", opts.controlAPI)
+		go http.Serve(listener, controlServer{tunnels, opts.controlToken})
 	}
 
 	destination := ""
-	if len(*tunnel) > 0 {
-		destination = *tunnel
+	if len(opts.execCommand) > 0 {
+		args, err := splitCommandLine(opts.execCommand)
+		if err != nil {
+			log.Fatal("client| ", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		// on Ctrl-C, let the agent kill the command before exiting
+		atexit.Register(func() {
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+		})
+		code, err := runRemoteCommand(ctx, hubClient, dispatcher, opts.agentTimeout, args, os.Stdout, os.Stderr)
+		close(done)
+		if err != nil {
+			log.Println("client|", err)
+		}
+		atexit.Exit(code)
+	} else if opts.shell {
+		stdinFd, stdoutFd := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+		restore := func() {}
+		if terminal.IsTerminal(stdinFd) {
+			state, err := terminal.MakeRaw(stdinFd)
+			if err != nil {
+				log.Fatal("client| failed to put terminal in raw mode. ", err)
+			}
+			restore = func() { terminal.Restore(stdinFd, state) }
+			atexit.Register(restore)
+		}
+		size := func() (int, int) {
+			cols, rows, err := terminal.GetSize(stdoutFd)
+			if err != nil {
+				return 0, 0
+			}
+			return rows, cols
+		}
+		resized := make(chan struct{}, 1)
+		go watchWindowSize(resized)
+		term := os.Getenv("TERM")
+		if len(term) == 0 {
+			term = "xterm"
+		}
+		code, err := runRemoteShell(hubClient, dispatcher, opts.agentTimeout, term, os.Stdin, os.Stdout, size, resized)
+		restore()
+		if err != nil {
+			log.Println("client|", err)
+		}
+		atexit.Exit(code)
+	} else if len(opts.putFile) > 0 || len(opts.getFile) > 0 {
+		if len(opts.args) != 1 {
+			log.Fatal("client| -put and -get must be followed by the destination path as last argument")
+		}
+		var err error
+		if len(opts.putFile) > 0 {
+			err = putRemoteFile(hubClient, dispatcher, opts.agentTimeout, opts.putFile, opts.args[0])
+		} else {
+			err = getRemoteFile(hubClient, dispatcher, opts.agentTimeout, opts.getFile, opts.args[0])
+		}
+		if err != nil {
+			log.Fatal("client| ", err)
+		}
+		log.Println("client| transfer completed")
+		atexit.Exit(0)
+	} else if len(opts.socks5) > 0 {
+		createSocks5Proxy(opts.socks5)
+	} else if len(opts.httpProxy) > 0 {
+		createHTTPProxy(opts.httpProxy)
+	} else if len(opts.reverse) > 0 && len(opts.tunnel) > 0 {
+		createOneReverseTunnel(opts.reverse, opts.tunnel)
+	} else if opts.udp && len(opts.tunnel) > 0 {
+		createOneUDPTunnel(listenIf, opts.tunnel)
+	} else if len(opts.tunnel) > 0 {
+		destination = opts.tunnel
 		createOneTunnel(listenIf, destination)
-	} else if len(*rdp) > 0 {
-		destination = *rdp
+	} else if len(opts.rdp) > 0 {
+		destination = opts.rdp
 		if strings.Index(destination, ":") == -1 {
 			destination = destination + ":3389"
 		}
 		createOneTunnel(listenIf, destination)
-	} else if len(*tunnelsFile) > 0 {
-		dat, err := ioutil.ReadFile(*tunnelsFile)
+	} else if len(opts.tunnelsFile) > 0 {
+		dat, err := ioutil.ReadFile(opts.tunnelsFile)
 		if err != nil {
-			log.Fatalf("failed to read JSON file %s. %s", *tunnelsFile, err)
+			log.Fatalf("failed to read JSON file %s. %s", opts.tunnelsFile, err)
 		}
 		var cfg clientConfig
 		err = json.Unmarshal(dat, &cfg)
 		if err != nil {
-			log.Fatalf("failed to parse JSON from file %s. %s", *tunnelsFile, err)
+			log.Fatalf("failed to parse JSON from file %s. %s", opts.tunnelsFile, err)
 		}
 		createTunnels(cfg)
+	} else if len(opts.controlAPI) > 0 {
+		log.Println("client| waiting for tunnels added through the control API")
+		select {}
 	} else {
-		log.Fatal("client| client must provide either -tunnel or -rdp arguments")
+		log.Fatal("client| client must provide either -tunnel, -rdp, -tunnels, -socks5, -http-proxy, -exec, -shell, -put, -get or -control arguments")
 	}
 
 }
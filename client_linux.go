@@ -1,4 +1,30 @@
+//go:build linux || darwin
 // +build linux darwin
+
 package main
 
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 var hostsFileName = `/etc/hosts`
+
+// watchWindowSize signals resized each time the terminal window is resized.
+func watchWindowSize(resized chan<- struct{}) {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	for range sigwinch {
+		resized <- struct{}{}
+	}
+}
+
+// listenUnixSocket listens on a unix socket only the current user can
+// connect to. The umask applies from its creation on, unlike a chmod.
+func listenUnixSocket(socket string) (net.Listener, error) {
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", socket)
+}
@@ -1,4 +1,33 @@
+//go:build windows
 // +build windows
+
 package main
 
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
 var hostsFileName = `c:\windows\system32\drivers\etc\hosts`
+
+// watchWindowSize signals resized each time the console window is resized.
+// Windows consoles have no resize signal so the size is polled.
+func watchWindowSize(resized chan<- struct{}) {
+	cols, rows, _ := terminal.GetSize(int(os.Stdout.Fd()))
+	for range time.Tick(500 * time.Millisecond) {
+		c, r, err := terminal.GetSize(int(os.Stdout.Fd()))
+		if err == nil && (c != cols || r != rows) {
+			cols, rows = c, r
+			resized <- struct{}{}
+		}
+	}
+}
+
+// listenUnixSocket listens on a unix socket. Windows sockets get the access
+// rights of their directory.
+func listenUnixSocket(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
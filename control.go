@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStatus describes a tcp tunnel of the client as reported by the control API.
+type TunnelStatus struct {
+	ID          int
+	Listen      string
+	Destination string
+	Created     time.Time
+	BytesSent   int64 // bytes sent to the destination by all connections, closed ones included
+	BytesRecv   int64 // bytes received from the destination by all connections, closed ones included
+	Connections []ConnectionStatus
+}
+
+// ConnectionStatus describes one local connection relayed by a tunnel.
+type ConnectionStatus struct {
+	RemoteAddr string
+	Opened     time.Time
+	BytesSent  int64
+	BytesRecv  int64
+}
+
+type tunnelsResponse struct {
+	Tunnels []TunnelStatus
+}
+
+type addTunnelRequest struct {
+	Listen, Destination string
+}
+
+// countingConn counts the bytes relayed for a local connection.
+type countingConn struct {
+	net.Conn
+	opened    time.Time
+	bytesSent int64 // read from the local connection, sent to the destination
+	bytesRecv int64 // received from the destination, written to the local connection
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	atomic.AddInt64(&conn.bytesSent, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	atomic.AddInt64(&conn.bytesRecv, int64(n))
+	return n, err
+}
+
+// localTunnel listens on a local address and relays each connection to a
+// destination reachable from the agent.
+type localTunnel struct {
+	id                  int
+	listen, destination string
+	listener            net.Listener
+	created             time.Time
+	closed              int32
+
+	lock      sync.Mutex // protects the fields below
+	conns     map[*countingConn]bool
+	bytesSent int64 // of closed connections
+	bytesRecv int64
+}
+
+// track counts conn in the tunnel until untrack is called.
+func (tunnel *localTunnel) track(conn net.Conn) *countingConn {
+	counted := &countingConn{Conn: conn, opened: time.Now()}
+	tunnel.lock.Lock()
+	tunnel.conns[counted] = true
+	tunnel.lock.Unlock()
+	if tunnel.isClosed() {
+		counted.Close()
+	}
+	return counted
+}
+
+func (tunnel *localTunnel) untrack(conn *countingConn) {
+	tunnel.lock.Lock()
+	defer tunnel.lock.Unlock()
+	delete(tunnel.conns, conn)
+	tunnel.bytesSent += atomic.LoadInt64(&conn.bytesSent)
+	tunnel.bytesRecv += atomic.LoadInt64(&conn.bytesRecv)
+}
+
+// close stops listening and closes the connections of the tunnel.
+func (tunnel *localTunnel) close() {
+	atomic.StoreInt32(&tunnel.closed, 1)
+	tunnel.listener.Close()
+	tunnel.lock.Lock()
+	defer tunnel.lock.Unlock()
+	for conn := range tunnel.conns {
+		conn.Close()
+	}
+}
+
+func (tunnel *localTunnel) isClosed() bool {
+	return atomic.LoadInt32(&tunnel.closed) == 1
+}
+
+func (tunnel *localTunnel) status() TunnelStatus {
+	tunnel.lock.Lock()
+	defer tunnel.lock.Unlock()
+	ts := TunnelStatus{
+		ID:          tunnel.id,
+		Listen:      tunnel.listen,
+		Destination: tunnel.destination,
+		Created:     tunnel.created,
+		BytesSent:   tunnel.bytesSent,
+		BytesRecv:   tunnel.bytesRecv,
+		Connections: make([]ConnectionStatus, 0, len(tunnel.conns)),
+	}
+	for conn := range tunnel.conns {
+		cs := ConnectionStatus{
+			RemoteAddr: conn.RemoteAddr().String(),
+			Opened:     conn.opened,
+			BytesSent:  atomic.LoadInt64(&conn.bytesSent),
+			BytesRecv:  atomic.LoadInt64(&conn.bytesRecv),
+		}
+		ts.BytesSent += cs.BytesSent
+		ts.BytesRecv += cs.BytesRecv
+		ts.Connections = append(ts.Connections, cs)
+	}
+	sort.Slice(ts.Connections, func(i, j int) bool { return ts.Connections[i].Opened.Before(ts.Connections[j].Opened) })
+	return ts
+}
+
+// tunnelRegistry holds the tcp tunnels of the client, opened from the
+// command line or through the control API.
+type tunnelRegistry struct {
+	serve   func(tunnel *localTunnel) // relays the connections of tunnel until it is closed
+	lock    sync.Mutex                // protects the fields below
+	nextID  int
+	tunnels map[int]*localTunnel
+}
+
+func newTunnelRegistry(serve func(tunnel *localTunnel)) *tunnelRegistry {
+	return &tunnelRegistry{serve: serve, tunnels: make(map[int]*localTunnel)}
+}
+
+// open listens on listen for connections to relay to destination. The
+// caller must run serve for the tunnel.
+func (registry *tunnelRegistry) open(listen, destination string) (*localTunnel, error) {
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		return nil, fmt.Errorf("invalid destination %q. Expecting host:port", destination)
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.nextID++
+	tunnel := &localTunnel{
+		id:          registry.nextID,
+		listen:      listen,
+		destination: destination,
+		listener:    listener,
+		created:     time.Now(),
+		conns:       make(map[*countingConn]bool),
+	}
+	registry.tunnels[tunnel.id] = tunnel
+	return tunnel, nil
+}
+
+// remove closes the tunnel with id. It returns false when there is none.
+func (registry *tunnelRegistry) remove(id int) bool {
+	registry.lock.Lock()
+	tunnel, found := registry.tunnels[id]
+	delete(registry.tunnels, id)
+	registry.lock.Unlock()
+	if found {
+		tunnel.close()
+	}
+	return found
+}
+
+// list returns a snapshot of the tunnels sorted by id.
+func (registry *tunnelRegistry) list() []TunnelStatus {
+	registry.lock.Lock()
+	tunnels := make([]*localTunnel, 0, len(registry.tunnels))
+	for _, tunnel := range registry.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	registry.lock.Unlock()
+	status := make([]TunnelStatus, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		status = append(status, tunnel.status())
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// controlServer serves the control API of the tunnel registry to local
+// processes. Web pages can also send requests to loopback addresses, so
+// requests must provide the token in the x-token header, name a loopback
+// host, which defeats DNS rebinding, and send JSON, which browsers only do
+// cross-origin after a preflight request the API does not answer.
+type controlServer struct {
+	tunnels *tunnelRegistry
+	token   string // not required on unix sockets when empty
+}
+
+func (server controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(server.token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("x-token")), []byte(server.token)) != 1 {
+		w.WriteHeader(401)
+		log.Println("client| invalid control API token provided by", r.RemoteAddr)
+		return
+	}
+	if !isLoopbackHost(r.Host) {
+		w.WriteHeader(403)
+		log.Println("client| control API refused request for host", r.Host)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			w.WriteHeader(415)
+			return
+		}
+	}
+	server.tunnels.serveControl(w, r)
+}
+
+// serveControl is the control API:
+//
+//	GET /tunnels lists the tunnels
+//	POST /tunnels with {"Listen": "127.0.0.1:8888", "Destination": "host:port"} adds one
+//	DELETE /tunnels/{id} removes one and closes its connections
+func (registry *tunnelRegistry) serveControl(w http.ResponseWriter, r *http.Request) {
+	writeJSON := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Println("client| failed to write control API response:", err)
+		}
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/tunnels" && r.Method == http.MethodGet:
+		writeJSON(200, tunnelsResponse{registry.list()})
+	case path == "/tunnels" && r.Method == http.MethodPost:
+		var req addTunnelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid tunnel. "+err.Error(), 400)
+			return
+		}
+		tunnel, err := registry.open(req.Listen, req.Destination)
+		if err != nil {
+			log.Println("client| control API failed to add tunnel.", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.Println("client| control API added tunnel", tunnel.id, "from", tunnel.listen, "to", tunnel.destination)
+		go registry.serve(tunnel)
+		writeJSON(201, tunnel.status())
+	case strings.HasPrefix(path, "/tunnels/") && r.Method == http.MethodDelete:
+		id, err := strconv.Atoi(strings.TrimPrefix(path, "/tunnels/"))
+		if err != nil || !registry.remove(id) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Println("client| control API removed tunnel", id)
+		w.WriteHeader(204)
+	case path == "/tunnels" || strings.HasPrefix(path, "/tunnels/"):
+		w.WriteHeader(405)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// isLoopbackHost tells whether host, with or without port, is localhost or
+// a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// listenControlAPI listens on a unix socket for unix:/path addresses and on
+// host:port otherwise. host must be a loopback address so only local
+// processes reach the API, and a token is required since every local user
+// can connect.
+func listenControlAPI(addr, token string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		// a socket left by a previous client prevents listening
+		if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(socket)
+		}
+		return listenUnixSocket(socket)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !isLoopbackHost(host) {
+		return nil, fmt.Errorf("control API must listen on a loopback address, not %q", host)
+	}
+	if len(token) == 0 {
+		return nil, fmt.Errorf("control API on a tcp address requires -control-token")
+	}
+	return net.Listen("tcp", addr)
+}
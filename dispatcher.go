@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dhx71/hub/hublib"
+	"github.com/google/uuid"
+)
+
+// controlDispatcher sends client requests on the control room and routes
+// each agent response to the goroutine waiting for its Refid, so many
+// requests can be pending at once. Requests go to the agent picked by selector.
+type controlDispatcher struct {
+	controlRoom *hublib.ResilientRoom
+	selector    *agentSelector
+	lock        sync.Mutex // protects waiters
+	waiters     map[string]chan agentResponse
+}
+
+func newControlDispatcher(controlRoom *hublib.ResilientRoom, selector *agentSelector) *controlDispatcher {
+	dispatcher := &controlDispatcher{
+		controlRoom: controlRoom,
+		selector:    selector,
+		waiters:     make(map[string]chan agentResponse),
+	}
+	go dispatcher.readLoop()
+	return dispatcher
+}
+
+func (dispatcher *controlDispatcher) readLoop() {
+	for {
+		var resp agentResponse
+		err := dispatcher.controlRoom.ReadJSON(&resp)
+		if err != nil {
+			if dispatcher.controlRoom.State() == hublib.RoomClosed {
+				log.Println("client| stopped reading room", *room, err)
+				return
+			}
+			continue
+		}
+		if resp.Type == "agentAnnounce" {
+			dispatcher.selector.update(resp)
+			continue
+		}
+		dispatcher.lock.Lock()
+		waiter, found := dispatcher.waiters[resp.Refid]
+		delete(dispatcher.waiters, resp.Refid)
+		dispatcher.lock.Unlock()
+		if found {
+			waiter <- resp
+		}
+	}
+}
+
+// request sends req with a new Refid and returns the agent response, or
+// an error when none came within timeout.
+func (dispatcher *controlDispatcher) request(req agentRequest, timeout time.Duration) (agentResponse, error) {
+	agent, err := dispatcher.selector.pick(timeout)
+	if err != nil {
+		return agentResponse{}, err
+	}
+	req.Agent = agent
+	req.Refid = uuid.New().String()
+	waiter := make(chan agentResponse, 1)
+	dispatcher.lock.Lock()
+	dispatcher.waiters[req.Refid] = waiter
+	dispatcher.lock.Unlock()
+	defer func() {
+		dispatcher.lock.Lock()
+		delete(dispatcher.waiters, req.Refid)
+		dispatcher.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = dispatcher.controlRoom.WriteJSONContext(ctx, &req)
+	if err != nil {
+		return agentResponse{}, fmt.Errorf("failed to send %s message. %w", req.Type, err)
+	}
+	dispatcher.selector.sent(agent)
+	select {
+	case resp := <-waiter:
+		return resp, nil
+	case <-ctx.Done():
+		return agentResponse{}, fmt.Errorf("agent did not answer %s request within %s. %w", req.Type, timeout, hublib.ErrTimeout)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/dhx71/hub/hublib"
+)
+
+// e2eKey returns the secret shared by client and agent to encrypt their
+// messages end-to-end, nil when end-to-end encryption is disabled.
+func e2eKey() []byte {
+	if len(*e2eSecret) > 0 {
+		return []byte(*e2eSecret)
+	}
+	if *e2e {
+		return []byte(*password)
+	}
+	return nil
+}
+
+// newE2EKeyPair returns an ephemeral key pair for one tunnel room, nil when
+// end-to-end encryption is disabled.
+func newE2EKeyPair() *hublib.KeyPair {
+	if e2eKey() == nil {
+		return nil
+	}
+	kp, err := hublib.NewKeyPair()
+	if err != nil {
+		log.Fatal("failed to generate end-to-end encryption key. ", err)
+	}
+	return kp
+}
+
+// publicKey returns the public key to send to the peer, empty when kp is nil.
+func publicKey(kp *hublib.KeyPair) string {
+	if kp == nil {
+		return ""
+	}
+	return kp.Public()
+}
+
+// controlRoomRejoinDelay is how long agents and reverse tunnels wait before
+// joining the control room again once the hub refused to let them back in.
+const controlRoomRejoinDelay = 30 * time.Second
+
+// joinControlRoom joins the room shared by agent and clients and joins it
+// again whenever the connection to the hub drops. announce, when not nil,
+// is called after each join once encryption is set up.
+func joinControlRoom(hubClient *hublib.Client, announce func(controlRoom *hublib.Room) error) (*hublib.ResilientRoom, error) {
+	return hubClient.JoinResilient(*room, *password, hublib.ReconnectOptions{
+		PingInterval: 30 * time.Second,
+		Setup: func(controlRoom *hublib.Room) error {
+			if key := e2eKey(); key != nil {
+				err := controlRoom.EncryptGroup(key)
+				if err != nil {
+					return err
+				}
+			}
+			if announce != nil {
+				return announce(controlRoom)
+			}
+			return nil
+		},
+	})
+}
+
+// joinTunnelRoom joins a room created for one tunnel and encrypts it with a
+// key agreed with the peer. The client requesting the tunnel is the initiator.
+func joinTunnelRoom(hubClient *hublib.Client, roomName, roomPassword string, kp *hublib.KeyPair, peerPublic string, initiator bool) (*hublib.Room, error) {
+	key := e2eKey()
+	if key != nil && len(peerPublic) == 0 {
+		return nil, fmt.Errorf("peer did not provide an end-to-end encryption key")
+	}
+	tunnel, err := hubClient.Join(roomName, roomPassword)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		err = tunnel.EncryptTunnel(key, kp, peerPublic, initiator)
+		if err != nil {
+			tunnel.Close()
+			return nil, err
+		}
+	}
+	return tunnel, nil
+}
+
+// relayTunnel relays conn through the tunnel room. When client and agent
+// agreed on it, resumeTimeout is not 0 and the room is joined again after hub
+// disconnections so the stream resumes without conn noticing.
+func relayTunnel(hubClient *hublib.Client, tunnel *hublib.Room, conn net.Conn, resumeTimeout time.Duration) {
+	if resumeTimeout == 0 {
+		tunnel.Relay(conn)
+		return
+	}
+	resilient := hubClient.NewResilientRoom(tunnel, hublib.ReconnectOptions{
+		MaxBackoff:   5 * time.Second,
+		PingInterval: 15 * time.Second,
+	})
+	resilient.RelayResumable(conn, hublib.ResumeOptions{Timeout: resumeTimeout})
+}
@@ -1,30 +1,130 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
 	"github.com/dhx71/hub/hublib"
+	"github.com/gorilla/websocket"
 )
 
-func setArgument(_client, _agent, _tunnel, _listen string, _dev, _bypassProxy bool) {
-	client = &_client
-	agent = &_agent
-	tunnel = &_tunnel
-	listen = &_listen
-	dev = &_dev
-	bypassProxy = &_bypassProxy
+// hubURL is the hub started by startHubAgentClient.
+const hubURL = "ws://localhost:8080/hub"
+
+var startOnce sync.Once
+
+// startHubAgentClient starts the hub on :8080 plus an agent and a client
+// tunneling :8888 to 127.0.0.1:7777. They are started once and shared by all tests.
+func startHubAgentClient(t *testing.T) {
+	startOnce.Do(func() {
+		// flags are set before anything reads them and never changed afterward
+		*agent = hubURL
+		*listen = ":8080"
+		*dev = true
+		*bypassProxy = true
+		*adminToken = "admin token"
+		go startServer()
+		waitDial(t, "127.0.0.1:8080").Close()
+		go startAgent()
+		opts := testClientOptions()
+		opts.listen, opts.tunnel = ":8888", "127.0.0.1:7777"
+		go startClient(opts)
+	})
 }
 
-func Test_HubClientsServer(t *testing.T) {
+// testClientOptions returns the settings of a client of the hub started by
+// startHubAgentClient, with the command line defaults and no tunnel.
+func testClientOptions() clientOptions {
+	opts := clientOptionsFromFlags()
+	opts.hub, opts.listen = hubURL, ""
+	return opts
+}
+
+// waitDial connects to addr, retrying until something listens on it. Tests
+// use the connection itself since a probe connection would also be tunneled.
+func waitDial(t *testing.T, addr string) net.Conn {
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("nothing listening on %s. %s", addr, err)
+		}
+	}
+}
+
+// testHubClient starts an isolated hub for one test and returns a client of it.
+func testHubClient(t *testing.T) *hublib.Client {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	t.Cleanup(srv.Close)
+	return hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+}
+
+// joinTestRoom joins control room roomName until the test ends.
+func joinTestRoom(t *testing.T, hubClient *hublib.Client, roomName string, options hublib.ReconnectOptions) *hublib.ResilientRoom {
+	r, err := hubClient.JoinResilient(roomName, "password", options)
+	if err != nil {
+		t.Fatalf("failed to join control room. %s", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
 
-	setArgument("ws://localhost:8080/hub", "ws://localhost:8080/hub", "127.0.0.1:7777", ":8080", true, true)
-	go startServer()
-	time.Sleep(time.Millisecond * 500)
+// startTestAgent serves the requests sent to room roomName with the agent
+// request loop, as agent name announcing labels and load.
+func startTestAgent(t *testing.T, hubClient *hublib.Client, roomName, name string, labels map[string]string, load int) {
+	announcement := func(refid string) agentResponse {
+		return agentResponse{Type: "agentAnnounce", Refid: refid, Name: name, Labels: labels, Load: load}
+	}
+	agentRoom := joinTestRoom(t, hubClient, roomName, hublib.ReconnectOptions{Setup: func(r *hublib.Room) error {
+		return r.WriteJSON(announcement(""))
+	}})
+	go serveAgentRequests(hubClient, agentRoom, name, announcement)
+}
+
+// newTestDispatcher joins room roomName as a client sending its requests to
+// the agents picked by selector.
+func newTestDispatcher(t *testing.T, hubClient *hublib.Client, roomName string, selector *agentSelector) *controlDispatcher {
+	clientRoom := joinTestRoom(t, hubClient, roomName, hublib.ReconnectOptions{Setup: func(r *hublib.Room) error {
+		return r.WriteJSON(agentRequest{Type: "discoverAgents"})
+	}})
+	return newControlDispatcher(clientRoom, selector)
+}
 
-	hubClient := hublib.NewClient(*agent, *token, true)
+func Test_HubClientsServer(t *testing.T) {
+	startHubAgentClient(t)
+
+	hubClient := hublib.NewClient(hubURL, *token, true, "")
 
 	s1, err := hubClient.Join("my room", "my password")
 	if err != nil {
@@ -98,8 +198,12 @@ func Test_HubClientsServer(t *testing.T) {
 }
 
 func Test_Tunnel_EndToEnd(t *testing.T) {
+	listener, err := net.Listen("tcp", ":7777")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
 	go func() {
-		listener, _ := net.Listen("tcp", ":7777")
+		defer listener.Close()
 		conn, _ := listener.Accept()
 		log.Println("Test_Tunnel_EndToEnd accepted connection on :7777")
 		defer conn.Close()
@@ -121,21 +225,9 @@ func Test_Tunnel_EndToEnd(t *testing.T) {
 		//time.Sleep(time.Second)
 	}()
 
-	setArgument("ws://localhost:8080/hub", "ws://localhost:8080/hub", "127.0.0.1:7777", ":8080", true, true)
-	go startServer()
+	startHubAgentClient(t)
 
-	time.Sleep(time.Millisecond * 500)
-
-	setArgument("ws://localhost:8080/hub", "ws://localhost:8080/hub", "127.0.0.1:7777", ":8888", true, true)
-	go startAgent()
-	time.Sleep(time.Millisecond * 500)
-	go startClient()
-	time.Sleep(time.Millisecond * 500)
-
-	conn, err := net.Dial("tcp", "127.0.0.1:8888")
-	if err != nil {
-		t.Errorf("failed to dial tunnel. %s", err)
-	}
+	conn := waitDial(t, "127.0.0.1:8888")
 	n, err := conn.Write([]byte("THIS IS A TEST"))
 	if n != 14 || err != nil {
 		log.Printf("TEST FAILED tunnel client failed to send to tunnel n:%d err:%v\n", n, err)
@@ -175,8 +267,11 @@ func Test_Multithreads_Tunnel_EndToEnd(t *testing.T) {
 		log.Printf("handleConn| closing... %s", conn.RemoteAddr().String())
 		conn.Close()
 	}
+	listener, err := net.Listen("tcp", ":7777")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
 	go func() {
-		listener, _ := net.Listen("tcp", ":7777")
 		for {
 			conn, _ := listener.Accept()
 			log.Println("Test_Tunnel_EndToEnd accepted connection on :7777")
@@ -185,24 +280,11 @@ func Test_Multithreads_Tunnel_EndToEnd(t *testing.T) {
 		//time.Sleep(time.Second)
 	}()
 
-	setArgument("ws://localhost:8080/hub", "ws://localhost:8080/hub", "127.0.0.1:7777", ":8080", true, true)
-	go startServer()
-
-	time.Sleep(time.Millisecond * 500)
-
-	setArgument("ws://localhost:8080/hub", "ws://localhost:8080/hub", "127.0.0.1:7777", ":8888", true, true)
-	go startAgent()
-	time.Sleep(time.Millisecond * 500)
-	go startClient()
-	time.Sleep(time.Millisecond * 1500)
+	startHubAgentClient(t)
 
 	log.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
 	wg := sync.WaitGroup{}
-	simulateClient := func(instanceNb int) {
-		conn, err := net.Dial("tcp", "127.0.0.1:8888")
-		if err != nil {
-			t.Errorf("tunnel client failed to dial. %s", err)
-		}
+	simulateClient := func(instanceNb int, conn net.Conn) {
 		log.Println("simulateClient| dialed to", conn.RemoteAddr().String())
 		n, err := conn.Write([]byte("THIS IS A TEST"))
 		if n != 14 || err != nil {
@@ -219,11 +301,2126 @@ func Test_Multithreads_Tunnel_EndToEnd(t *testing.T) {
 		conn.Close()
 		wg.Done()
 	}
+	// the first connection waits for the client to listen
+	wg.Add(1)
+	simulateClient(0, waitDial(t, "127.0.0.1:8888"))
 	for i := 1; i <= 200; i++ {
 		wg.Add(1)
-		go simulateClient(i)
+		go func(i int) {
+			conn, err := net.Dial("tcp", "127.0.0.1:8888")
+			if err != nil {
+				t.Errorf("tunnel client failed to dial. %s", err)
+				wg.Done()
+				return
+			}
+			simulateClient(i, conn)
+		}(i)
 	}
 
 	wg.Wait()
 	time.Sleep(time.Second)
 }
+
+func Test_AdminRooms(t *testing.T) {
+	startHubAgentClient(t)
+
+	resp, err := http.Get("http://localhost:8080/hub/rooms")
+	if err != nil {
+		t.Fatalf("failed to query admin API. %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("admin API should require a token. status: %d", resp.StatusCode)
+	}
+
+	// agent and client join the control room in the background
+	var rooms []hublib.RoomStatus
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		rooms = adminRooms(t)
+		for _, room := range rooms {
+			if room.Name == "control room" && room.ParticipantCount == 2 && len(room.Participants) == 2 {
+				return
+			}
+		}
+	}
+	t.Errorf("control room with agent and client as participants not listed by admin API. %v", rooms)
+}
+
+// adminRooms lists the rooms of the hub started by startHubAgentClient.
+func adminRooms(t *testing.T) []hublib.RoomStatus {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/hub/rooms", nil)
+	req.Header.Set("x-token", "admin token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to query admin API. %s", err)
+	}
+	defer resp.Body.Close()
+	var list struct{ Rooms []hublib.RoomStatus }
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode admin API response. %s", err)
+	}
+	return list.Rooms
+}
+
+func Test_IsolatedHubs(t *testing.T) {
+	hub1 := hublib.NewHub(hublib.HubOptions{Token: "token 1"})
+	hub2 := hublib.NewHub(hublib.HubOptions{Token: "token 2"})
+	srv1 := httptest.NewServer(hub1)
+	defer srv1.Close()
+	srv2 := httptest.NewServer(hub2)
+	defer srv2.Close()
+	client1 := hublib.NewClient("ws"+strings.TrimPrefix(srv1.URL, "http"), "token 1", true, "")
+	client2 := hublib.NewClient("ws"+strings.TrimPrefix(srv2.URL, "http"), "token 2", true, "")
+
+	r1, err := client1.Join("same room", "password 1")
+	if err != nil {
+		t.Fatalf("failed to join room on hub 1. %s", err)
+	}
+	_, err = client2.Join("same room", "password 2")
+	if err != nil {
+		t.Fatalf("failed to join room on hub 2. rooms should not be shared. %s", err)
+	}
+	if len(hub1.Rooms()) != 1 || len(hub2.Rooms()) != 1 {
+		t.Errorf("each hub should have its own room. hub1: %v, hub2: %v", hub1.Rooms(), hub2.Rooms())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = hub1.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("failed to shutdown hub 1. %s", err)
+	}
+	var msg map[string]interface{}
+	if r1.ReadJSON(&msg) == nil {
+		t.Errorf("room on hub 1 should be closed after shutdown")
+	}
+	if len(hub1.Rooms()) != 0 {
+		t.Errorf("hub 1 should not have rooms after shutdown. %v", hub1.Rooms())
+	}
+	_, err = client1.Join("same room", "password 1")
+	if err == nil {
+		t.Errorf("should not be able to join a room on a hub that is shut down")
+	}
+	if len(hub2.Rooms()) != 1 {
+		t.Errorf("hub 2 should not be affected by hub 1 shutdown. %v", hub2.Rooms())
+	}
+}
+
+func Test_MultiplexedStreams(t *testing.T) {
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token"})
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	hubClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+
+	agentRoom, err := hubClient.Join("mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	clientRoom, err := hubClient.Join("mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	agentSession := hublib.NewSession(agentRoom, false)
+	defer agentSession.Close()
+	clientSession := hublib.NewSession(clientRoom, true)
+	defer clientSession.Close()
+
+	// agent side echoes every stream targeting "echo" and rejects the others
+	go func() {
+		for {
+			stream, err := agentSession.Accept()
+			if err != nil {
+				return
+			}
+			if stream.Target() != "echo" {
+				stream.Reject("unknown target")
+				continue
+			}
+			stream.Ack()
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	_, err = clientSession.Open("nowhere")
+	if err == nil {
+		t.Errorf("should not be able to open a stream rejected by the peer")
+	}
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), hublib.StreamWindow/8)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := clientSession.Open("echo")
+			if err != nil {
+				t.Errorf("stream #%d failed to open. %s", i, err)
+				return
+			}
+			defer stream.Close()
+			go stream.Write(payload)
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			echoed := make([]byte, len(payload))
+			_, err = io.ReadFull(stream, echoed)
+			if err != nil || !bytes.Equal(echoed, payload) {
+				t.Errorf("stream #%d did not echo payload. err: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// streams waiting to be accepted do not stall the open ones
+	agentRoom, err = hubClient.Join("busy mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	clientRoom, err = hubClient.Join("busy mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	busySession := hublib.NewSession(agentRoom, false)
+	defer busySession.Close()
+	clientSession = hublib.NewSession(clientRoom, true)
+	defer clientSession.Close()
+	go func() {
+		stream, err := busySession.Accept()
+		if err != nil {
+			return
+		}
+		stream.Ack()
+		io.Copy(stream, stream)
+	}()
+	echo, err := clientSession.Open("echo")
+	if err != nil {
+		t.Fatalf("failed to open stream. %s", err)
+	}
+	rejected := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			_, err := clientSession.Open("echo")
+			rejected <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case err = <-rejected:
+			if err == nil {
+				t.Errorf("stream should be rejected while 16 streams wait to be accepted")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("streams should be rejected while 16 streams wait to be accepted")
+		}
+	}
+	echo.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err = io.ReadFull(echo, pong); err != nil || string(pong) != "ping" {
+		t.Errorf("open stream should not be stalled by streams waiting to be accepted. %q %v", pong, err)
+	}
+
+	// a peer ignoring the window gets its session closed
+	agentRoom, err = hubClient.Join("greedy mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	clientRoom, err = hubClient.Join("greedy mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	greedySession := hublib.NewSession(agentRoom, false)
+	defer greedySession.Close()
+	go func() {
+		stream, err := greedySession.Accept()
+		if err == nil {
+			stream.Ack()
+		}
+	}()
+	rawPeer := hublib.NewRoomConn(clientRoom)
+	defer rawPeer.Close()
+	rawPeer.Write(muxFrame(1, 1, []byte("echo")))
+	for i := 0; i <= hublib.StreamWindow/(32*1024); i++ {
+		rawPeer.Write(muxFrame(4, 1, make([]byte, 32*1024)))
+	}
+	select {
+	case <-greedySession.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("session should be closed once a stream exceeds its window")
+	}
+
+	// streams opened with an id in use or with the other peer parity are rejected
+	agentRoom, err = hubClient.Join("strict mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	clientRoom, err = hubClient.Join("strict mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	strictSession := hublib.NewSession(agentRoom, false)
+	defer strictSession.Close()
+	go func() {
+		for {
+			stream, err := strictSession.Accept()
+			if err != nil {
+				return
+			}
+			stream.Ack()
+		}
+	}()
+	rawPeer = hublib.NewRoomConn(clientRoom)
+	defer rawPeer.Close()
+	rawPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, id := range []uint32{1, 1, 2} {
+		rawPeer.Write(muxFrame(1, id, []byte("echo")))
+		answer := make([]byte, 64)
+		n, err := rawPeer.Read(answer)
+		if err != nil || n < 5 || binary.BigEndian.Uint32(answer[1:]) != id {
+			t.Fatalf("session did not answer stream %d. %v", id, err)
+		}
+		if accepted := answer[0] == 2; accepted != (i == 0) {
+			t.Errorf("stream %d open #%d should be accepted: %v, got frame type %d", id, i+1, i == 0, answer[0])
+		}
+	}
+
+	// opening a stream the peer never answers gives up with the context
+	agentRoom, err = hubClient.Join("silent mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	clientRoom, err = hubClient.Join("silent mux room", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	silentSession := hublib.NewSession(agentRoom, false)
+	defer silentSession.Close()
+	clientSession = hublib.NewSession(clientRoom, true)
+	defer clientSession.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = clientSession.OpenContext(ctx, "echo"); !errors.Is(err, hublib.ErrTimeout) {
+		t.Errorf("stream open should time out. got %v", err)
+	}
+	unanswered, err := silentSession.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept stream. %s", err)
+	}
+	unanswered.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = unanswered.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stream given up by its opener should be closed. got %v", err)
+	}
+}
+
+// muxFrame builds a multiplexed session frame, for tests playing a peer
+// that does not follow the protocol.
+func muxFrame(ft byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = ft
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[5:], payload)
+	return frame
+}
+
+func Test_MultiplexedTunnel_EndToEnd(t *testing.T) {
+	startHubAgentClient(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:7786")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	opts := testClientOptions()
+	opts.listen, opts.tunnel, opts.multiplex = "127.0.0.1:7787", "127.0.0.1:7786", true
+	go startClient(opts)
+	echo := func(conn net.Conn, msg string) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Errorf("multiplexed tunnel didn't echo message. got: %q, err: %v", buf, err)
+		}
+	}
+	first := waitDial(t, "127.0.0.1:7787")
+	defer first.Close()
+	echo(first, "first stream")
+	rooms := len(adminRooms(t))
+
+	// connections are streams of the session opened for the first one
+	conns := make([]net.Conn, 5)
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", "127.0.0.1:7787")
+		if err != nil {
+			t.Fatalf("failed to dial multiplexed tunnel. %s", err)
+		}
+		defer conns[i].Close()
+	}
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			echo(conn, fmt.Sprintf("stream #%d", i))
+		}(i, conn)
+	}
+	wg.Wait()
+	if n := len(adminRooms(t)); n != rooms {
+		t.Errorf("multiplexed connections should not open rooms. %d rooms instead of %d", n, rooms)
+	}
+}
+
+func Test_ReverseTunnel_EndToEnd(t *testing.T) {
+	startHubAgentClient(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:7778")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	opts := testClientOptions()
+	opts.tunnel, opts.reverse = "127.0.0.1:7778", "127.0.0.1:7779"
+	go startClient(opts)
+
+	conn := waitDial(t, "127.0.0.1:7779")
+	defer conn.Close()
+	_, err = conn.Write([]byte("THIS IS A TEST"))
+	if err != nil {
+		t.Errorf("failed to write to reverse tunnel. %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "THIS IS A TEST" {
+		t.Errorf("reverse tunnel didn't echo message. got: %q, err: %v", buf, err)
+	}
+}
+
+func Test_ReverseTunnelLifetime(t *testing.T) {
+	hubClient := testHubClient(t)
+	agentRoom := joinTestRoom(t, hubClient, "reverse", hublib.ReconnectOptions{})
+	clientRoom := joinTestRoom(t, hubClient, "reverse", hublib.ReconnectOptions{})
+	answer := func() agentResponse {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			var resp agentResponse
+			if err := clientRoom.ReadJSONContext(ctx, &resp); err != nil {
+				t.Fatalf("agent did not answer. %s", err)
+			}
+			// connections made to check the listener are announced too
+			if resp.Type != "reverseConnection" {
+				return resp
+			}
+		}
+	}
+
+	listenIf := "127.0.0.1:7790"
+	createReverseTunnel(hubClient, agentRoom, listenIf, "first", "", false)
+	defer closeReverseTunnel(listenIf, "second")
+	if resp := answer(); resp.Type != "reverseTunnelCreated" {
+		t.Fatalf("agent should create reverse tunnel. got %v", resp)
+	}
+	reachable := func() bool {
+		conn, err := net.Dial("tcp", listenIf)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}
+	if !reachable() {
+		t.Fatalf("agent should listen for reverse tunnel connections")
+	}
+	// another client can't take the listener over while it is leased
+	createReverseTunnel(hubClient, agentRoom, listenIf, "second", "", false)
+	if resp := answer(); resp.Type != "reverseTunnelCreationFailed" || resp.Refid != "second" {
+		t.Errorf("reverse tunnel leased to another client should be refused. got %v", resp)
+	}
+	if closeReverseTunnel(listenIf, "second") || !reachable() {
+		t.Fatalf("refused client should not own the reverse tunnel")
+	}
+	// once the lease expired, it takes the listener over and renewals of the
+	// first client are ignored
+	reverseTunnelsLock.Lock()
+	reverseTunnels[listenIf].renewed = time.Now().Add(-reverseLeaseTimeout - time.Second)
+	reverseTunnelsLock.Unlock()
+	createReverseTunnel(hubClient, agentRoom, listenIf, "second", "", false)
+	if resp := answer(); resp.Type != "reverseTunnelCreated" || resp.Refid != "second" {
+		t.Errorf("expired reverse tunnel should be taken over. got %v", resp)
+	}
+	createReverseTunnel(hubClient, agentRoom, listenIf, "first", "", true)
+	if closeReverseTunnel(listenIf, "first") || !reachable() {
+		t.Errorf("only the client owning the reverse tunnel should close it")
+	}
+	if !closeReverseTunnel(listenIf, "second") || reachable() {
+		t.Errorf("agent should stop listening once the reverse tunnel is closed")
+	}
+
+	// without a policy, reverse tunnels are only reachable from the agent host
+	for _, listenIf := range []string{"0.0.0.0:7791", ":7791", "10.0.0.1:7791"} {
+		createReverseTunnel(hubClient, agentRoom, listenIf, "third", "", false)
+		if resp := answer(); resp.Type != "reverseTunnelCreationFailed" {
+			t.Errorf("listening on %s should be refused without a policy. got %v", listenIf, resp)
+			closeReverseTunnel(listenIf, "third")
+		}
+	}
+}
+
+func Test_UDPTunnel_EndToEnd(t *testing.T) {
+	startHubAgentClient(t)
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:7780")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	opts := testClientOptions()
+	opts.listen, opts.tunnel, opts.udp = "127.0.0.1:7781", "127.0.0.1:7780", true
+	go startClient(opts)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:7781")
+		if err != nil {
+			t.Fatalf("failed to dial udp tunnel. %s", err)
+		}
+		defer conn.Close()
+		// datagrams are lost until the client listens, send them again
+		buf := make([]byte, 1500)
+		n := 0
+		for start := time.Now(); time.Since(start) < 10*time.Second; {
+			conn.Write([]byte("THIS IS A TEST"))
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if n, err = conn.Read(buf); err == nil {
+				break
+			}
+		}
+		if err != nil || string(buf[:n]) != "THIS IS A TEST" {
+			t.Errorf("udp flow #%d didn't echo datagram. got: %q, err: %v", i, buf[:n], err)
+		}
+	}
+}
+
+func Test_RelayUDPTimeout(t *testing.T) {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	defer srv.Close()
+	hubClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	for _, idleTimeout := range []time.Duration{0, time.Nanosecond} {
+		r, err := hubClient.Join("udp", "password")
+		if err != nil {
+			t.Fatalf("failed to join room. %s", err)
+		}
+		udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7782})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() { done <- r.RelayUDP(udpConn, idleTimeout) }()
+		// invalid timeouts must not make the idle check panic
+		time.Sleep(100 * time.Millisecond)
+		udpConn.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("udp relay with idle timeout %s should close with its udp conn", idleTimeout)
+		}
+	}
+}
+
+func Test_Socks5Proxy_EndToEnd(t *testing.T) {
+	startHubAgentClient(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:7782")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	opts := testClientOptions()
+	opts.socks5 = "127.0.0.1:7783"
+	go startClient(opts)
+
+	conn := waitDial(t, "127.0.0.1:7783")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != 0 {
+		t.Fatalf("socks5 proxy refused unauthenticated access. reply: %v, err: %v", reply, err)
+	}
+	host := "localhost"
+	conn.Write(append(append([]byte{5, 1, 0, 3, byte(len(host))}, host...), 7782>>8, 7782&0xff))
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != 0 {
+		t.Fatalf("socks5 connect failed. reply: %v, err: %v", reply, err)
+	}
+	conn.Write([]byte("THIS IS A TEST"))
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "THIS IS A TEST" {
+		t.Errorf("socks5 tunnel didn't echo message. got: %q, err: %v", buf, err)
+	}
+}
+
+func Test_HTTPProxy_EndToEnd(t *testing.T) {
+	startHubAgentClient(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.URL.Path))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	opts := testClientOptions()
+	opts.httpProxy = "127.0.0.1:7784"
+	go startClient(opts)
+	// a connection without request is not tunneled
+	waitDial(t, "127.0.0.1:7784").Close()
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:7784")
+	transport := secure.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	httpClient := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	for _, base := range []string{plain.URL, secure.URL} {
+		resp, err := httpClient.Get(base + "/path")
+		if err != nil {
+			t.Errorf("failed to get %s through http proxy. %s", base, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello from /path" {
+			t.Errorf("unexpected response from %s through http proxy. %q", base, body)
+		}
+	}
+}
+
+func Test_AgentPolicy(t *testing.T) {
+	policy, err := compilePolicy(agentPolicyConfig{
+		Default: "deny",
+		Rules: []policyRule{
+			{Action: "deny", Hosts: []string{"10.0.0.1", "*.admin.lab"}},
+			{Action: "allow", Hosts: []string{"10.0.0.0/24", "server1.lab"}, Ports: "22,3389,8000-8999"},
+			{Action: "allow", Hosts: []string{"*.web.lab"}, Ports: "443"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile policy. %s", err)
+	}
+	resolved := map[string][]net.IP{
+		"server1.lab":      {net.ParseIP("10.0.5.1")},
+		"server2.lab":      {net.ParseIP("10.9.9.9")},
+		"intranet.web.lab": {net.ParseIP("10.1.1.1")},
+		"db.admin.lab":     {net.ParseIP("10.0.0.1")},
+		"rebind.lab":       {net.ParseIP("10.0.0.2")},
+	}
+	policy.lookupIP = func(host string) ([]net.IP, error) {
+		if ips, found := resolved[host]; found {
+			return ips, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	for destination, allowed := range map[string]bool{
+		"10.0.0.1:22":          false,
+		"10.0.0.2:22":          true,
+		"10.0.0.2:8080":        true,
+		"10.0.0.2:9000":        false,
+		"10.0.1.2:22":          false,
+		"server1.lab:3389":     true,
+		"SERVER1.LAB:3389":     true,
+		"server2.lab:3389":     false,
+		"db.admin.lab:3389":    false,
+		"intranet.web.lab:443": true,
+		"intranet.web.lab:80":  false,
+		"unknown.lab:22":       false,
+		"not a destination":    false,
+	} {
+		_, err := policy.Check(destination)
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed. %s", destination, err)
+		} else if !allowed && err == nil {
+			t.Errorf("%s should be denied", destination)
+		}
+	}
+
+	_, err = compilePolicy(agentPolicyConfig{Rules: []policyRule{{Action: "allow", Ports: "9000-80"}}})
+	if err == nil {
+		t.Errorf("invalid port range should be rejected")
+	}
+
+	listenPolicy, err := compilePolicy(agentPolicyConfig{Listen: []policyRule{{Action: "allow", Hosts: []string{"127.0.0.1"}, Ports: "9000-9099"}}})
+	if err != nil {
+		t.Fatalf("failed to compile listen rules. %s", err)
+	}
+	for listenIf, allowed := range map[string]bool{
+		"127.0.0.1:9000": true,
+		"127.0.0.1:22":   false,
+		"0.0.0.0:9000":   false,
+		":9000":          false,
+	} {
+		_, err := listenPolicy.CheckListen(listenIf)
+		if allowed && err != nil {
+			t.Errorf("listening on %s should be allowed. %s", listenIf, err)
+		} else if !allowed && err == nil {
+			t.Errorf("listening on %s should be denied", listenIf)
+		}
+	}
+	if _, err = listenPolicy.Check("10.0.0.2:22"); err == nil {
+		t.Errorf("destinations should be denied by default")
+	}
+
+	// the agent dials the checked address even if the name resolves elsewhere by then
+	ips, err := policy.Check("rebind.lab:22")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("allowed destination should return its checked addresses. ips: %v, err: %v", ips, err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conn, err := dialDestination("tcp", "rebind.lab:"+port, []net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to dial checked address. %s", err)
+	}
+	conn.Close()
+}
+
+func Test_EndToEndEncryption(t *testing.T) {
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token"})
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	hubClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	join := func(name string) *hublib.Room {
+		r, err := hubClient.Join(name, "password")
+		if err != nil {
+			t.Fatalf("failed to join room %s. %s", name, err)
+		}
+		return r
+	}
+
+	agentControl, clientControl, eavesdropper := join("control"), join("control"), join("control")
+	defer agentControl.Close()
+	defer clientControl.Close()
+	defer eavesdropper.Close()
+	agentControl.EncryptGroup([]byte("e2e secret"))
+	clientControl.EncryptGroup([]byte("e2e secret"))
+
+	clientKey, _ := hublib.NewKeyPair()
+	err := clientControl.WriteJSON(agentRequest{Type: "createTunnel", PublicKey: clientKey.Public()})
+	if err != nil {
+		t.Fatalf("failed to write encrypted json. %s", err)
+	}
+	var req agentRequest
+	err = agentControl.ReadJSON(&req)
+	if err != nil || req.Type != "createTunnel" {
+		t.Fatalf("agent failed to read encrypted request. req: %v, err: %v", req, err)
+	}
+	var spied agentRequest
+	captured, err := eavesdropper.ReadDatagram()
+	if err != nil || json.Unmarshal(captured, &spied) == nil {
+		t.Errorf("participant without the key should not read encrypted messages. %v", spied)
+	}
+	// the hub operator sends the recorded request again
+	eavesdropper.WriteDatagram(captured)
+	var replayed agentRequest
+	if err = agentControl.ReadJSON(&replayed); err == nil {
+		t.Errorf("agent should reject replayed messages")
+	}
+	clientControl.WriteJSON(agentRequest{Type: "ping"})
+	if err = agentControl.ReadJSON(&replayed); err != nil || replayed.Type != "ping" {
+		t.Errorf("agent should still read new messages after a replay. req: %v, err: %v", replayed, err)
+	}
+
+	agentKey, _ := hublib.NewKeyPair()
+	agentTunnel, clientTunnel := join("tunnel"), join("tunnel")
+	defer agentTunnel.Close()
+	defer clientTunnel.Close()
+	err = agentTunnel.EncryptTunnel([]byte("e2e secret"), agentKey, req.PublicKey, false)
+	if err != nil {
+		t.Fatalf("failed to encrypt agent tunnel. %s", err)
+	}
+	err = clientTunnel.EncryptTunnel([]byte("e2e secret"), clientKey, agentKey.Public(), true)
+	if err != nil {
+		t.Fatalf("failed to encrypt client tunnel. %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		clientTunnel.WriteDatagram([]byte("THIS IS A TEST"))
+		p, err := agentTunnel.ReadDatagram()
+		if err != nil || string(p) != "THIS IS A TEST" {
+			t.Errorf("agent failed to read encrypted datagram #%d. got: %q, err: %v", i, p, err)
+		}
+		agentTunnel.WriteDatagram([]byte("THIS IS A REPLY"))
+		p, err = clientTunnel.ReadDatagram()
+		if err != nil || string(p) != "THIS IS A REPLY" {
+			t.Errorf("client failed to read encrypted datagram #%d. got: %q, err: %v", i, p, err)
+		}
+	}
+
+	wrongKey, _ := hublib.NewKeyPair()
+	intruder := join("tunnel")
+	defer intruder.Close()
+	intruder.EncryptTunnel([]byte("wrong secret"), wrongKey, agentKey.Public(), true)
+	intruder.WriteDatagram([]byte("FORGED"))
+	_, err = agentTunnel.ReadDatagram()
+	if err == nil {
+		t.Errorf("agent should reject messages sealed without the shared secret")
+	}
+}
+
+func Test_ResilientRoom(t *testing.T) {
+	var hub *hublib.Hub
+	serve := func(addr string) (*http.Server, string) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %s. %s", addr, err)
+		}
+		hub = hublib.NewHub(hublib.HubOptions{Token: "token"})
+		srv := &http.Server{Handler: hub}
+		go srv.Serve(listener)
+		return srv, listener.Addr().String()
+	}
+	srv, addr := serve("127.0.0.1:0")
+	hubClient := hublib.NewClient("ws://"+addr, "token", true, "")
+
+	var states []hublib.RoomState
+	var statesLock sync.Mutex
+	peer, err := hubClient.Join("resilient", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	rr, err := hubClient.JoinResilient("resilient", "password", hublib.ReconnectOptions{
+		MinBackoff: 50 * time.Millisecond,
+		MaxBackoff: 200 * time.Millisecond,
+		OnStateChange: func(state hublib.RoomState, err error) {
+			statesLock.Lock()
+			states = append(states, state)
+			statesLock.Unlock()
+		}})
+	if err != nil {
+		t.Fatalf("failed to join resilient room. %s", err)
+	}
+	defer rr.Close()
+
+	// restart the hub on the same address while the room is in use
+	srv.Close()
+	hub.Shutdown(context.Background())
+	peer.Close()
+	var msg map[string]string
+	readDone := make(chan error)
+	go func() { readDone <- rr.ReadJSON(&msg) }()
+	time.Sleep(300 * time.Millisecond)
+	srv, _ = serve(addr)
+	for start := time.Now(); rr.State() != hublib.RoomConnected; time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("room should be connected again after the hub restarted. state: %s", rr.State())
+		}
+	}
+	peer, err = hubClient.Join("resilient", "password")
+	if err != nil {
+		t.Fatalf("failed to join room again. %s", err)
+	}
+	defer peer.Close()
+	peer.WriteJSON(map[string]string{"msg": "THIS IS A TEST"})
+	select {
+	case err = <-readDone:
+		if err != nil || msg["msg"] != "THIS IS A TEST" {
+			t.Errorf("failed to read from reconnected room. msg: %v, err: %v", msg, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timeout reading from reconnected room")
+	}
+	err = rr.WriteJSON(map[string]string{"msg": "THIS IS A REPLY"})
+	if err != nil {
+		t.Errorf("failed to write to reconnected room. %s", err)
+	}
+	statesLock.Lock()
+	if len(states) < 3 || states[len(states)-2] != hublib.RoomReconnecting || states[len(states)-1] != hublib.RoomConnected {
+		t.Errorf("unexpected state changes %v", states)
+	}
+	statesLock.Unlock()
+
+	_, err = hubClient.JoinResilient("resilient", "wrong password", hublib.ReconnectOptions{})
+	if err == nil {
+		t.Errorf("joining with a wrong password should fail without retrying")
+	}
+	rr.Close()
+	if rr.State() != hublib.RoomClosed || rr.WriteJSON(msg) == nil {
+		t.Errorf("closed room should not be usable. state: %s", rr.State())
+	}
+	srv.Close()
+}
+
+func Test_ResilientRoomPing(t *testing.T) {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	defer srv.Close()
+	// the proxy stops forwarding the connections opened before freezing,
+	// like a network link silently going down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var frozen int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			hubConn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			generation := atomic.LoadInt32(&frozen)
+			forward := func(dst, src net.Conn) {
+				buf := make([]byte, 4096)
+				for {
+					n, err := src.Read(buf)
+					if err != nil {
+						dst.Close()
+						return
+					}
+					if atomic.LoadInt32(&frozen) == generation {
+						dst.Write(buf[:n])
+					}
+				}
+			}
+			go forward(conn, hubConn)
+			go forward(hubConn, conn)
+		}
+	}()
+
+	states := make(chan hublib.RoomState, 10)
+	hubClient := hublib.NewClient("ws://"+listener.Addr().String(), "token", true, "")
+	rr, err := hubClient.JoinResilient("ping", "password", hublib.ReconnectOptions{
+		MinBackoff:    50 * time.Millisecond,
+		PingInterval:  100 * time.Millisecond,
+		OnStateChange: func(state hublib.RoomState, err error) { states <- state }})
+	if err != nil {
+		t.Fatalf("failed to join resilient room. %s", err)
+	}
+	defer rr.Close()
+	<-states
+	var msg map[string]string
+	readDone := make(chan error)
+	go func() { readDone <- rr.ReadJSON(&msg) }()
+
+	// pongs keep the room connected
+	time.Sleep(500 * time.Millisecond)
+	if rr.State() != hublib.RoomConnected {
+		t.Fatalf("room answering pings should stay connected. state: %s", rr.State())
+	}
+	atomic.AddInt32(&frozen, 1)
+	for _, want := range []hublib.RoomState{hublib.RoomReconnecting, hublib.RoomConnected} {
+		select {
+		case state := <-states:
+			if state != want {
+				t.Fatalf("room should be %s, not %s", want, state)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("room without pongs should be %s. state: %s", want, rr.State())
+		}
+	}
+	peer, err := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "").Join("ping", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	defer peer.Close()
+	peer.WriteJSON(map[string]string{"msg": "THIS IS A TEST"})
+	select {
+	case err = <-readDone:
+		if err != nil || msg["msg"] != "THIS IS A TEST" {
+			t.Errorf("failed to read from reconnected room. msg: %v, err: %v", msg, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timeout reading from reconnected room")
+	}
+}
+
+func Test_ContextErrors(t *testing.T) {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	hubUrl := "ws" + strings.TrimPrefix(srv.URL, "http")
+	hubClient := hublib.NewClient(hubUrl, "token", true, "")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := hubClient.JoinContext(ctx, "context", "password")
+	if err != nil {
+		t.Fatalf("failed to join room. %s", err)
+	}
+	defer r.Close()
+	start := time.Now()
+	readCtx, readCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer readCancel()
+	var msg map[string]string
+	err = r.ReadJSONContext(readCtx, &msg)
+	if !errors.Is(err, hublib.ErrTimeout) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("reading an idle room should time out. err: %v after %s", err, time.Since(start))
+	}
+
+	_, err = hubClient.JoinContext(ctx, "context", "wrong password")
+	if !errors.Is(err, hublib.ErrAuth) {
+		t.Errorf("wrong room password should be an auth error. %v", err)
+	}
+	_, err = hublib.NewClient(hubUrl, "wrong token", true, "").JoinContext(ctx, "context", "password")
+	if !errors.Is(err, hublib.ErrAuth) {
+		t.Errorf("wrong token should be an auth error. %v", err)
+	}
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	_, err = hubClient.JoinContext(canceled, "context", "password")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("join with a canceled context should fail with context.Canceled. %v", err)
+	}
+	srv.Close()
+	_, err = hubClient.JoinContext(ctx, "context", "password")
+	if !errors.Is(err, hublib.ErrHubUnavailable) {
+		t.Errorf("closed hub should be unavailable. %v", err)
+	}
+}
+
+func Test_ClientOptions(t *testing.T) {
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token"})
+	var seenLock sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenLock.Lock()
+		seen = append(seen, r.Header.Get("x-client"))
+		seenLock.Unlock()
+		hub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	hubUrl := "ws" + strings.TrimPrefix(srv.URL, "http")
+	defaultDialer := websocket.DefaultDialer
+
+	direct := hublib.NewClientWithOptions(hubUrl, hublib.ClientOptions{
+		Token:       "token",
+		BypassProxy: true,
+		Header:      http.Header{"X-Client": []string{"direct"}}})
+	proxied := hublib.NewClientWithOptions(hubUrl, hublib.ClientOptions{
+		Token: "token",
+		Proxy: func(*http.Request) (*url.URL, error) {
+			return url.Parse("http://127.0.0.1:1")
+		},
+		HandshakeTimeout: time.Second})
+	hublib.NewClient(hubUrl, "token", false, "http://127.0.0.1:1")
+	if websocket.DefaultDialer != defaultDialer {
+		t.Errorf("creating clients should not change websocket.DefaultDialer")
+	}
+
+	r, err := direct.Join("options", "password")
+	if err != nil {
+		t.Fatalf("direct client failed to join room. %s", err)
+	}
+	r.Close()
+	_, err = proxied.Join("options", "password")
+	if !errors.Is(err, hublib.ErrHubUnavailable) {
+		t.Errorf("client using an unreachable proxy should not reach the hub. %v", err)
+	}
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	if len(seen) != 1 || seen[0] != "direct" {
+		t.Errorf("hub should only see the direct client with its custom header. %v", seen)
+	}
+}
+
+// writeTestCert creates a certificate signed by parent, or self-signed when
+// parent is nil, and writes it and its key as PEM files in dir.
+func writeTestCert(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(dir+"/"+name+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(dir+"/"+name+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func Test_HubTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "clients-ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clients CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token", RequireClientCert: true})
+	srv := httptest.NewUnstartedServer(hub)
+	srv.TLS = &tls.Config{}
+	err = hublib.ServerTLSConfig(srv.TLS, dir+"/clients-ca.pem")
+	if err != nil {
+		t.Fatalf("failed to load client CA. %s", err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	hubCert := srv.Certificate()
+	ioutil.WriteFile(dir+"/hub.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hubCert.Raw}), 0600)
+	hubUrl := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	join := func(caFile, certFile, keyFile string, pins []string) error {
+		tlsConfig, err := hublib.ClientTLSConfig(caFile, certFile, keyFile, pins)
+		if err != nil {
+			return err
+		}
+		hubClient := hublib.NewClientWithOptions(hubUrl, hublib.ClientOptions{
+			Token: "token", BypassProxy: true, TLSConfig: tlsConfig})
+		r, err := hubClient.Join("tls", "password")
+		if err == nil {
+			r.Close()
+		}
+		return err
+	}
+	clientCert, clientKey := dir+"/client.pem", dir+"/client-key.pem"
+	if err = join(dir+"/hub.pem", clientCert, clientKey, nil); err != nil {
+		t.Errorf("client trusting the hub CA with a client certificate should join. %s", err)
+	}
+	if err = join(dir+"/hub.pem", "", "", nil); !errors.Is(err, hublib.ErrAuth) {
+		t.Errorf("client without certificate should be refused. %v", err)
+	}
+	if err = join("", clientCert, clientKey, nil); err == nil {
+		t.Errorf("client should not trust the hub certificate without CA nor pin")
+	}
+	pin := hublib.Fingerprint(hubCert)
+	if err = join("", clientCert, clientKey, []string{strings.ToUpper(pin[:2]) + ":" + pin[2:]}); err != nil {
+		t.Errorf("client pinning the hub certificate should join. %s", err)
+	}
+	if err = join("", clientCert, clientKey, []string{hublib.Fingerprint(ca)}); err == nil {
+		t.Errorf("client should refuse a hub certificate not matching the pin")
+	}
+	if err = join(dir+"/hub.pem", clientCert, clientKey, []string{pin}); err != nil {
+		t.Errorf("client trusting the hub CA and pinning its certificate should join. %s", err)
+	}
+	if err = join(dir+"/hub.pem", clientCert, clientKey, []string{hublib.Fingerprint(ca)}); err == nil {
+		t.Errorf("client trusting the hub CA should refuse a chain not matching the pin")
+	}
+	if _, err = hublib.ClientTLSConfig("", "", "", []string{"not a fingerprint"}); err == nil {
+		t.Errorf("invalid fingerprint should be rejected")
+	}
+
+	// a man in the middle presents its own certificate followed by the public pinned one
+	foreign, foreignKey := writeTestCert(t, dir, "foreign", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "foreign"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+	mitm := httptest.NewUnstartedServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	mitm.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{foreign.Raw, hubCert.Raw},
+		PrivateKey:  foreignKey,
+	}}}
+	mitm.StartTLS()
+	defer mitm.Close()
+	hubUrl = "wss" + strings.TrimPrefix(mitm.URL, "https")
+	if err = join("", "", "", []string{pin}); err == nil {
+		t.Errorf("client should refuse a foreign certificate followed by the pinned one")
+	}
+}
+
+func Test_CertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeCert := func(serial int64, modTime time.Time) {
+		writeTestCert(t, dir, "hub", &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "hub"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, nil, nil)
+		os.Chtimes(dir+"/hub.pem", modTime, modTime)
+		os.Chtimes(dir+"/hub-key.pem", modTime, modTime)
+	}
+	served := func(reloader *hublib.CertReloader) int64 {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("failed to get certificate. %s", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+
+	writeCert(1, time.Now().Add(-time.Minute))
+	reloader, err := hublib.NewCertReloader(dir+"/hub.pem", dir+"/hub-key.pem")
+	if err != nil {
+		t.Fatalf("failed to load certificate. %s", err)
+	}
+	if serial := served(reloader); serial != 1 {
+		t.Errorf("expected certificate #1, got #%d", serial)
+	}
+	writeCert(2, time.Now())
+	if serial := served(reloader); serial != 2 {
+		t.Errorf("renewed certificate should be served. got #%d", serial)
+	}
+	ioutil.WriteFile(dir+"/hub.pem", []byte("being written"), 0600)
+	if serial := served(reloader); serial != 2 {
+		t.Errorf("previous certificate should be kept while files are invalid. got #%d", serial)
+	}
+	if _, err = hublib.NewCertReloader(dir+"/missing.pem", dir+"/hub-key.pem"); err == nil {
+		t.Errorf("loading missing files should fail")
+	}
+}
+
+func Test_RoomConn(t *testing.T) {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	defer srv.Close()
+	hubClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	join := func() *hublib.RoomConn {
+		r, err := hubClient.Join("conn", "password")
+		if err != nil {
+			t.Fatalf("failed to join room. %s", err)
+		}
+		return hublib.NewRoomConn(r)
+	}
+	a, b := join(), join()
+	var _ net.Conn = a
+
+	sent := bytes.Repeat([]byte("THIS IS A TEST"), 10000)
+	go a.Write(sent)
+	received := make([]byte, len(sent))
+	_, err := io.ReadFull(b, received)
+	if err != nil || !bytes.Equal(sent, received) {
+		t.Fatalf("failed to read what was written. err: %v", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = b.Read(received)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read should time out. %v", err)
+	}
+	b.SetReadDeadline(time.Time{})
+
+	// http over the room, b serving one request
+	go func() {
+		req, err := http.ReadRequest(bufio.NewReader(b))
+		if err != nil {
+			t.Errorf("failed to read http request. %s", err)
+			return
+		}
+		body := "pong " + req.URL.Path
+		(&http.Response{
+			StatusCode:    200,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+		}).Write(b)
+	}()
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) { return a, nil }}}
+	resp, err := httpClient.Get("http://room/ping")
+	if err != nil {
+		t.Fatalf("http request over room failed. %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pong /ping" {
+		t.Errorf("unexpected http response %q", body)
+	}
+
+	a.Close()
+	_, err = b.Read(received)
+	if err != io.EOF {
+		t.Errorf("peer should read EOF once the conn is closed. %v", err)
+	}
+	if _, err = a.Write(sent); err == nil {
+		t.Errorf("writing to a closed conn should fail")
+	}
+	b.Close()
+}
+
+func Test_ListenDial(t *testing.T) {
+	srv := httptest.NewServer(hublib.NewHub(hublib.HubOptions{Token: "token"}))
+	defer srv.Close()
+	hubClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+
+	listener, err := hublib.Listen(hubClient, "service", "password")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	httpSrv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	})}
+	go httpSrv.Serve(listener)
+	defer httpSrv.Close()
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return hublib.DialContext(ctx, hubClient, "service", "password")
+		},
+		DisableKeepAlives: true}}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/request%d", i)
+			resp, err := httpClient.Get("http://service" + path)
+			if err != nil {
+				t.Errorf("http request over hub failed. %s", err)
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello "+path {
+				t.Errorf("unexpected response %q", body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if listener.Addr().String() != "service" {
+		t.Errorf("listener address should be its room. %s", listener.Addr())
+	}
+	listener.Close()
+	if _, err = listener.Accept(); err == nil {
+		t.Errorf("accept should fail once the listener is closed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = hublib.DialContext(ctx, hubClient, "service", "password"); !errors.Is(err, hublib.ErrTimeout) {
+		t.Errorf("dial without listener should time out. %v", err)
+	}
+}
+
+func Test_AgentTransport(t *testing.T) {
+	hubClient := testHubClient(t)
+	// an agent serving its own control room
+	startTestAgent(t, hubClient, "lab", "lab", nil, 0)
+
+	var connsLock sync.Mutex
+	conns := 0
+	labHost := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("lab " + r.URL.Path))
+	}))
+	labHost.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connsLock.Lock()
+			conns++
+			connsLock.Unlock()
+		}
+	}
+	labHost.Config.IdleTimeout = 200 * time.Millisecond
+	labHost.Start()
+	defer labHost.Close()
+
+	dialer := &hublib.AgentDialer{Client: hubClient, Room: "lab", Password: "password"}
+	defer dialer.Close()
+	transport := hublib.NewAgentTransport(dialer)
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport, Timeout: 2 * time.Second}
+	get := func(path string) {
+		resp, err := httpClient.Get(labHost.URL + path)
+		if err != nil {
+			t.Fatalf("request through agent failed. %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "lab "+path {
+			t.Errorf("unexpected response %q", body)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		get(fmt.Sprintf("/pooled%d", i))
+	}
+	connsLock.Lock()
+	if conns != 1 {
+		t.Errorf("idle tunnel should be reused. %d connections made", conns)
+	}
+	connsLock.Unlock()
+
+	// the lab host closes the idle connection and the transport must notice
+	time.Sleep(500 * time.Millisecond)
+	get("/after-idle")
+	connsLock.Lock()
+	if conns != 2 {
+		t.Errorf("a new tunnel should replace the closed one. %d connections made", conns)
+	}
+	connsLock.Unlock()
+
+	_, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:53")
+	if err == nil {
+		t.Errorf("only tcp can be dialed")
+	}
+
+	// with several agents in the room, only the named one opens tunnels and
+	// all dials share one control room
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token"})
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	labClient := hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	startTestAgent(t, labClient, "shared lab", "east", nil, 0)
+	startTestAgent(t, labClient, "shared lab", "west", nil, 0)
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen. %s", err)
+	}
+	defer destination.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	nextAccepted := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatalf("agent did not connect to the destination")
+			return nil
+		}
+	}
+	labParticipants := func() []hublib.ParticipantStatus {
+		for _, room := range hub.Rooms() {
+			if room.Name == "shared lab" {
+				return room.Participants
+			}
+		}
+		return nil
+	}
+
+	westDialer := &hublib.AgentDialer{Client: labClient, Room: "shared lab", Password: "password", Agent: "west"}
+	defer westDialer.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := westDialer.DialContext(context.Background(), "tcp", destination.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial through agent. %s", err)
+		}
+		defer conn.Close()
+		defer nextAccepted().Close()
+	}
+	select {
+	case <-accepted:
+		t.Errorf("only the named agent should connect to the destination")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if participants := labParticipants(); len(participants) != 3 {
+		t.Errorf("dials should share one control room. %d participants in it", len(participants))
+	}
+
+	// without a name, tunnels opened by the other agents are closed
+	anyDialer := &hublib.AgentDialer{Client: labClient, Room: "shared lab", Password: "password"}
+	defer anyDialer.Close()
+	conn, err := anyDialer.DialContext(context.Background(), "tcp", destination.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial through any agent. %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x"))
+	closed := 0
+	for i := 0; i < 2; i++ {
+		destConn := nextAccepted()
+		defer destConn.Close()
+		destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := destConn.Read(make([]byte, 1)); err == io.EOF {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("the unused tunnel should be closed. %d destination connections closed", closed)
+	}
+}
+
+func Test_ControlDispatcher(t *testing.T) {
+	hubClient := testHubClient(t)
+	agentRoom := joinTestRoom(t, hubClient, "dispatch", hublib.ReconnectOptions{})
+
+	// a fake agent answers each request after a delay given by its destination,
+	// so responses come back in another order than requests were sent
+	go func() {
+		for {
+			var req agentRequest
+			if err := agentRoom.ReadJSON(&req); err != nil {
+				return
+			}
+			if req.Destination == "never" {
+				continue
+			}
+			go func(req agentRequest) {
+				delay, _ := time.ParseDuration(req.Destination)
+				time.Sleep(delay)
+				agentRoom.WriteJSON(agentResponse{Type: "tunnelCreated", Refid: req.Refid, Room: req.Destination})
+			}(req)
+		}
+	}()
+
+	selector, _ := newAgentSelector("", "", "")
+	dispatcher := newTestDispatcher(t, hubClient, "dispatch", selector)
+	var wg sync.WaitGroup
+	for _, delay := range []string{"300ms", "200ms", "100ms", "0s"} {
+		wg.Add(1)
+		go func(delay string) {
+			defer wg.Done()
+			resp, err := dispatcher.request(agentRequest{Type: "createTunnel", Destination: delay}, time.Second)
+			if err != nil || resp.Room != delay {
+				t.Errorf("request %s got response %v. err: %v", delay, resp, err)
+			}
+		}(delay)
+	}
+	wg.Wait()
+
+	start := time.Now()
+	_, err := dispatcher.request(agentRequest{Type: "createTunnel", Destination: "never"}, 100*time.Millisecond)
+	if !errors.Is(err, hublib.ErrTimeout) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("unanswered request should time out. err: %v after %s", err, time.Since(start))
+	}
+}
+
+func Test_AgentSelection(t *testing.T) {
+	hubClient := testHubClient(t)
+	startTestAgent(t, hubClient, "site", "lab-a", map[string]string{"site": "lab"}, 5)
+	startTestAgent(t, hubClient, "site", "lab-b", map[string]string{"site": "lab"}, 0)
+	startTestAgent(t, hubClient, "site", "prod", map[string]string{"site": "prod"}, 0)
+
+	// agents only answer the requests addressed to them, an observer in the
+	// room tells which agent each request went to
+	observer := joinTestRoom(t, hubClient, "site", hublib.ReconnectOptions{})
+	addressedTo := make(chan string, 16)
+	go func() {
+		for {
+			var req agentRequest
+			if err := observer.ReadJSON(&req); err != nil {
+				if observer.State() == hublib.RoomClosed {
+					return
+				}
+				continue
+			}
+			if req.Type == "createTunnel" {
+				addressedTo <- req.Agent
+			}
+		}
+	}()
+
+	answeredBy := func(name, labels, mode string, requests int) map[string]int {
+		selector, err := newAgentSelector(name, labels, mode)
+		if err != nil {
+			t.Fatalf("invalid selector. %s", err)
+		}
+		dispatcher := newTestDispatcher(t, hubClient, "site", selector)
+		counts := make(map[string]int)
+		for i := 0; i < requests; i++ {
+			// the agent fails to dial the missing destination, an answer all the same
+			if _, err := dispatcher.request(agentRequest{Type: "createTunnel"}, 300*time.Millisecond); err != nil {
+				counts["error"]++
+				continue
+			}
+			select {
+			case agent := <-addressedTo:
+				counts[agent]++
+			case <-time.After(time.Second):
+				t.Fatalf("observer did not see request")
+			}
+		}
+		return counts
+	}
+
+	if counts := answeredBy("prod", "", "", 3); counts["prod"] != 3 {
+		t.Errorf("all requests should go to the named agent. %v", counts)
+	}
+	if counts := answeredBy("", "site=lab", "round-robin", 4); counts["lab-a"] != 2 || counts["lab-b"] != 2 {
+		t.Errorf("requests should alternate between the lab agents. %v", counts)
+	}
+	if counts := answeredBy("", "site=lab", "least-loaded", 5); counts["lab-b"] != 5 {
+		t.Errorf("requests should go to the least loaded lab agent. %v", counts)
+	}
+	if counts := answeredBy("ghost", "", "", 1); counts["error"] != 1 {
+		t.Errorf("requests to an unknown agent should fail. %v", counts)
+	}
+	if _, err := newAgentSelector("", "site", ""); err == nil {
+		t.Errorf("labels without value should be rejected")
+	}
+	if _, err := newAgentSelector("", "", "random"); err == nil {
+		t.Errorf("unknown selection mode should be rejected")
+	}
+}
+
+func Test_RunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test commands need a unix shell")
+	}
+	hubClient := testHubClient(t)
+	allowedCommands["sh"], allowedCommands["sleep"] = true, true
+	defer func() {
+		delete(allowedCommands, "sh")
+		delete(allowedCommands, "sleep")
+	}()
+	startTestAgent(t, hubClient, "exec", "agent", nil, 0)
+	selector, _ := newAgentSelector("", "", "")
+	dispatcher := newTestDispatcher(t, hubClient, "exec", selector)
+
+	args, err := splitCommandLine(`sh -c 'echo "hello world"; echo oops >&2; exit 3'`)
+	if err != nil || len(args) != 3 {
+		t.Fatalf("failed to split command line. %q %v", args, err)
+	}
+	var stdout, stderr bytes.Buffer
+	code, err := runRemoteCommand(context.Background(), hubClient, dispatcher, 5*time.Second, args, &stdout, &stderr)
+	if err != nil || code != 3 || stdout.String() != "hello world\n" || stderr.String() != "oops\n" {
+		t.Errorf("unexpected command result. code %d, stdout %q, stderr %q, err %v", code, stdout.String(), stderr.String(), err)
+	}
+
+	_, err = runRemoteCommand(context.Background(), hubClient, dispatcher, 5*time.Second, []string{"rm", "-rf", "/"}, &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("command not allowed should be refused. err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = runRemoteCommand(ctx, hubClient, dispatcher, 5*time.Second, []string{"sleep", "10"}, &stdout, &stderr)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("canceled command should be killed. err: %v after %s", err, time.Since(start))
+	}
+
+	// a command is killed once its room fails since nobody reads its output anymore
+	hub := hublib.NewHub(hublib.HubOptions{Token: "token"})
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	hubClient = hublib.NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	startTestAgent(t, hubClient, "exec", "agent", nil, 0)
+	dispatcher = newTestDispatcher(t, hubClient, "exec", selector)
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{
+		Type:      "runCommand",
+		Command:   []string{"sh", "-c", "echo $$; exec sleep 300"},
+		PublicKey: publicKey(kp)}, 5*time.Second)
+	if err != nil || resp.Type != "commandRoomCreated" {
+		t.Fatalf("agent should run command. resp: %v, err: %v", resp, err)
+	}
+	commandRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		t.Fatalf("failed to join command room. %s", err)
+	}
+	commandRoom.WriteJSON(agentRequest{Type: "startCommand", Refid: resp.Refid})
+	var output agentResponse
+	var pid int
+	if err = commandRoom.ReadJSON(&output); err == nil {
+		fmt.Sscanf(string(output.Data), "%d", &pid)
+	}
+	if pid == 0 {
+		t.Fatalf("command did not print its pid. got %v, err: %v", output, err)
+	}
+	hub.Shutdown(context.Background())
+	running := func() bool {
+		process, err := os.FindProcess(pid)
+		return err == nil && process.Signal(syscall.Signal(0)) == nil
+	}
+	for start := time.Now(); running(); time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("command %d is still running after its room failed", pid)
+		}
+	}
+
+	if _, err = splitCommandLine(`echo "unterminated`); err == nil {
+		t.Errorf("unterminated quote should be rejected")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for one writer and concurrent readers.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func Test_RemoteShell(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("remote shells need a linux agent")
+	}
+	hubClient := testHubClient(t)
+	startTestAgent(t, hubClient, "shell", "agent", nil, 0)
+	selector, _ := newAgentSelector("", "", "")
+	dispatcher := newTestDispatcher(t, hubClient, "shell", selector)
+	defer os.Setenv("SHELL", os.Getenv("SHELL"))
+	os.Setenv("SHELL", "/bin/sh")
+
+	size := func() (int, int) { return 24, 80 }
+	if _, err := runRemoteShell(hubClient, dispatcher, 5*time.Second, "xterm", strings.NewReader(""), ioutil.Discard, size, nil); err == nil {
+		t.Errorf("shell should be refused unless allowed")
+	}
+	*allowShell = true
+	defer func() { *allowShell = false }()
+
+	var rows, cols int32 = 24, 80
+	size = func() (int, int) { return int(atomic.LoadInt32(&rows)), int(atomic.LoadInt32(&cols)) }
+	resized := make(chan struct{})
+	stdin, typing := io.Pipe()
+	var stdout syncBuffer
+	waitOutput := func(s string) {
+		for start := time.Now(); !strings.Contains(stdout.String(), s); time.Sleep(50 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("shell did not print %q. output: %q", s, stdout.String())
+			}
+		}
+	}
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		code, err := runRemoteShell(hubClient, dispatcher, 5*time.Second, "xterm", stdin, &stdout, size, resized)
+		done <- result{code, err}
+	}()
+	typing.Write([]byte("stty size\n"))
+	waitOutput("24 80")
+	atomic.StoreInt32(&rows, 30)
+	atomic.StoreInt32(&cols, 100)
+	resized <- struct{}{}
+	time.Sleep(200 * time.Millisecond)
+	typing.Write([]byte("stty size; exit 7\n"))
+	waitOutput("30 100")
+	select {
+	case res := <-done:
+		if res.err != nil || res.code != 7 {
+			t.Errorf("shell should exit with code 7. code %d, err %v", res.code, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("shell did not exit")
+	}
+
+	// commands started by the shell are killed when the client is gone
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{Type: "createShell", PublicKey: publicKey(kp)}, 5*time.Second)
+	if err != nil || resp.Type != "shellCreated" {
+		t.Fatalf("failed to create shell. %v %+v", err, resp)
+	}
+	shellRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		t.Fatalf("failed to join shell room. %s", err)
+	}
+	shellRoom.WriteJSON(agentRequest{Type: "startShell", Refid: resp.Refid, Rows: 24, Cols: 80})
+	sc := newShellConn(shellRoom)
+	sc.write(shellData, []byte("sh -c 'trap \"\" HUP; echo pid=$$.; exec sleep 300'\n"))
+	var output string
+	var pid int
+	for !strings.Contains(output, ".\r\n") {
+		_, payload, err := sc.read()
+		if err != nil {
+			t.Fatalf("failed to read shell output. %s", err)
+		}
+		output += string(payload)
+	}
+	if fmt.Sscanf(output[strings.LastIndex(output, "pid="):], "pid=%d.", &pid); pid == 0 {
+		t.Fatalf("shell did not print the command pid. output: %q", output)
+	}
+	sc.conn.Close()
+	running := func() bool {
+		// killed processes may stay as zombies until reaped
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		return err == nil && !strings.Contains(string(stat), ") Z ")
+	}
+	for start := time.Now(); running(); time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("command %d started by the shell is still running", pid)
+		}
+	}
+}
+
+func Test_FileTransfer(t *testing.T) {
+	hubClient := testHubClient(t)
+	startTestAgent(t, hubClient, "files", "agent", nil, 0)
+	selector, _ := newAgentSelector("", "", "")
+	dispatcher := newTestDispatcher(t, hubClient, "files", selector)
+
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	agentDir, clientDir := filepath.Join(dir, "agent"), filepath.Join(dir, "client")
+	os.Mkdir(agentDir, 0755)
+	os.Mkdir(clientDir, 0755)
+	content := make([]byte, 300000)
+	rand.Read(content)
+	local := filepath.Join(clientDir, "build.bin")
+	ioutil.WriteFile(local, content, 0644)
+
+	if err = putRemoteFile(hubClient, dispatcher, 5*time.Second, local, "builds/build.bin"); err == nil {
+		t.Errorf("transfers should be refused unless allowed")
+	}
+	*allowFiles = agentDir
+	defer func() { *allowFiles = "" }()
+
+	// the agent already received the first half of the file
+	remote := filepath.Join(agentDir, "builds", "build.bin")
+	os.MkdirAll(filepath.Dir(remote), 0755)
+	ioutil.WriteFile(remote+".part", content[:150000], 0644)
+	if err = putRemoteFile(hubClient, dispatcher, 5*time.Second, local, "/../builds/build.bin"); err != nil {
+		t.Fatalf("failed to put file. %s", err)
+	}
+	if got, _ := ioutil.ReadFile(remote); !bytes.Equal(got, content) {
+		t.Errorf("put file differs. got %d bytes", len(got))
+	}
+
+	// the client received a corrupted beginning of the file
+	fetched := filepath.Join(clientDir, "fetched.bin")
+	ioutil.WriteFile(fetched+".part", make([]byte, 1000), 0644)
+	if err = getRemoteFile(hubClient, dispatcher, 5*time.Second, "builds/build.bin", fetched); err == nil {
+		t.Errorf("corrupted transfer should fail checksum verification")
+	}
+	if _, err = os.Stat(fetched + ".part"); !os.IsNotExist(err) {
+		t.Errorf("corrupted partial file should be removed. %v", err)
+	}
+	ioutil.WriteFile(fetched+".part", content[:1000], 0644)
+	if err = getRemoteFile(hubClient, dispatcher, 5*time.Second, "builds/build.bin", fetched); err != nil {
+		t.Fatalf("failed to get file. %s", err)
+	}
+	if got, _ := ioutil.ReadFile(fetched); !bytes.Equal(got, content) {
+		t.Errorf("fetched file differs. got %d bytes", len(got))
+	}
+	if err = getRemoteFile(hubClient, dispatcher, 5*time.Second, "missing.bin", fetched); err == nil {
+		t.Errorf("getting a missing file should fail")
+	}
+
+	// the allowed directory itself is not a file
+	for _, p := range []string{"", "/", ".", "builds/.."} {
+		if err = putRemoteFile(hubClient, dispatcher, 5*time.Second, local, p); err == nil {
+			t.Errorf("putting to %q should be refused", p)
+		}
+	}
+	if _, err = os.Stat(agentDir + ".part"); !os.IsNotExist(err) {
+		t.Errorf("no file should be written next to the allowed directory. %v", err)
+	}
+
+	// symbolic links could lead out of the allowed directory
+	outside := filepath.Join(dir, "outside")
+	os.Mkdir(outside, 0755)
+	ioutil.WriteFile(filepath.Join(outside, "secret.bin"), content, 0644)
+	if err = os.Symlink(outside, filepath.Join(agentDir, "link")); err != nil {
+		t.Skip("symbolic links are not supported.", err)
+	}
+	if err = getRemoteFile(hubClient, dispatcher, 5*time.Second, "link/secret.bin", fetched); err == nil {
+		t.Errorf("getting a file through a symbolic link should be refused")
+	}
+	if err = putRemoteFile(hubClient, dispatcher, 5*time.Second, local, "link/put.bin"); err == nil {
+		t.Errorf("putting a file through a symbolic link should be refused")
+	}
+	if _, err = os.Stat(filepath.Join(outside, "put.bin.part")); !os.IsNotExist(err) {
+		t.Errorf("no file should be written through a symbolic link. %v", err)
+	}
+	os.Symlink(filepath.Join(outside, "secret.bin"), filepath.Join(agentDir, "builds", "other.bin.part"))
+	if err = putRemoteFile(hubClient, dispatcher, 5*time.Second, local, "builds/other.bin"); err == nil {
+		t.Errorf("writing a partial file through a symbolic link should be refused")
+	}
+}
+
+func Test_TunnelResumption(t *testing.T) {
+	var hub *hublib.Hub
+	serve := func(addr string) (*http.Server, string) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %s. %s", addr, err)
+		}
+		hub = hublib.NewHub(hublib.HubOptions{Token: "token"})
+		srv := &http.Server{Handler: hub}
+		go srv.Serve(listener)
+		return srv, listener.Addr().String()
+	}
+	srv, addr := serve("127.0.0.1:0")
+	hubClient := hublib.NewClient("ws://"+addr, "token", true, "")
+	// encrypted tunnels must keep their sequence numbers across joins
+	*e2eSecret = "resume key"
+	defer func() { *e2eSecret = "" }()
+
+	startTestAgent(t, hubClient, "resume", "agent", nil, 0)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	echoClosed := make(chan struct{})
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		close(echoClosed)
+	}()
+
+	selector, _ := newAgentSelector("", "", "")
+	dispatcher := newTestDispatcher(t, hubClient, "resume", selector)
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{Type: "createTunnel", Destination: echo.Addr().String(), PublicKey: publicKey(kp), Resume: true}, time.Second)
+	if err != nil || !resp.Resume {
+		t.Fatalf("agent should create a resumable tunnel. resp: %v, err: %v", resp, err)
+	}
+	tunnel, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		t.Fatalf("failed to join tunnel room. %s", err)
+	}
+	app, relayed := net.Pipe()
+	go relayTunnel(hubClient, tunnel, relayed, *resumeTimeout)
+	expectEcho := func(msg string) {
+		app.SetDeadline(time.Now().Add(10 * time.Second))
+		go app.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(app, buf); err != nil || string(buf) != msg {
+			t.Fatalf("expected echo %q. got %q, err: %v", msg, buf, err)
+		}
+	}
+	expectEcho("before the drop")
+
+	// restart the hub while data is on its way
+	srv.Close()
+	hub.Shutdown(context.Background())
+	go app.Write([]byte("during the drop"))
+	time.Sleep(300 * time.Millisecond)
+	srv, _ = serve(addr)
+	defer srv.Close()
+	buf := make([]byte, len("during the drop"))
+	if _, err := io.ReadFull(app, buf); err != nil || string(buf) != "during the drop" {
+		t.Fatalf("tunnel should resume after the hub restarted. got %q, err: %v", buf, err)
+	}
+	expectEcho("after the drop")
+
+	app.Close()
+	select {
+	case <-echoClosed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("closing the connection should close the destination connection")
+	}
+}
+
+func Test_ControlAPI(t *testing.T) {
+	startHubAgentClient(t)
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// tunnels added through the control API relay their connections through the agent
+	opts := testClientOptions()
+	opts.controlAPI, opts.controlToken = "127.0.0.1:7791", "control token"
+	go startClient(opts)
+	waitDial(t, "127.0.0.1:7791").Close()
+	controlURL := "http://127.0.0.1:7791"
+
+	call := func(method, path, contentType, body string) *http.Response {
+		req, _ := http.NewRequest(method, controlURL+path, strings.NewReader(body))
+		req.Header.Set("x-token", "control token")
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to call control API. %s", err)
+		}
+		return resp
+	}
+	list := func() []TunnelStatus {
+		resp := call(http.MethodGet, "/tunnels", "", "")
+		defer resp.Body.Close()
+		var status tunnelsResponse
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status.Tunnels
+	}
+	add := func(listen, destination string) (*http.Response, TunnelStatus) {
+		body := fmt.Sprintf(`{"Listen":%q,"Destination":%q}`, listen, destination)
+		resp := call(http.MethodPost, "/tunnels", "application/json", body)
+		defer resp.Body.Close()
+		var status TunnelStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp, status
+	}
+
+	listen := "127.0.0.1:7792"
+	resp, tunnel := add(listen, echo.Addr().String())
+	if resp.StatusCode != 201 || tunnel.ID != 1 {
+		t.Fatalf("failed to add tunnel. got status %d, tunnel %+v", resp.StatusCode, tunnel)
+	}
+	if resp, _ = add("127.0.0.1:0", "nowhere"); resp.StatusCode != 400 {
+		t.Errorf("tunnel with invalid destination should be refused. got status %d", resp.StatusCode)
+	}
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatalf("failed to connect to added tunnel. %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("failed to relay through added tunnel. got %q, %v", buf, err)
+	}
+	status := list()
+	if len(status) != 1 || len(status[0].Connections) != 1 {
+		t.Fatalf("expecting one tunnel with one connection. got %+v", status)
+	}
+	if status[0].BytesSent != 5 || status[0].BytesRecv != 5 || status[0].Connections[0].BytesSent != 5 {
+		t.Errorf("wrong byte counters. got %+v", status[0])
+	}
+
+	if resp = call(http.MethodDelete, "/tunnels/1", "", ""); resp.StatusCode != 204 {
+		t.Fatalf("failed to remove tunnel. got status %d", resp.StatusCode)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(buf); err == nil {
+		t.Errorf("removing tunnel should close its connections")
+	}
+	if _, err = net.Dial("tcp", listen); err == nil {
+		t.Errorf("removed tunnel should stop listening")
+	}
+	if status = list(); len(status) != 0 {
+		t.Errorf("expecting no tunnel. got %+v", status)
+	}
+	if resp = call(http.MethodDelete, "/tunnels/1", "", ""); resp.StatusCode != 404 {
+		t.Errorf("removing unknown tunnel should fail. got status %d", resp.StatusCode)
+	}
+
+	// web pages can reach loopback addresses too
+	if resp = call(http.MethodPost, "/tunnels", "text/plain", `{"Listen":"0.0.0.0:0","Destination":"intranet:22"}`); resp.StatusCode != 415 {
+		t.Errorf("tunnels should only be added with JSON requests. got status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, controlURL+"/tunnels", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != 401 {
+		t.Errorf("requests without token should be refused. %v", err)
+	}
+	req.Header.Set("x-token", "control token")
+	req.Host = "rebound.example.com"
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != 403 {
+		t.Errorf("requests for other hosts should be refused. %v", err)
+	}
+	if status = list(); len(status) != 0 {
+		t.Errorf("refused requests should not add tunnels. got %+v", status)
+	}
+
+	if _, err = listenControlAPI("0.0.0.0:0", "control token"); err == nil {
+		t.Errorf("control API should only listen on loopback addresses")
+	}
+	if _, err = listenControlAPI("127.0.0.1:0", ""); err == nil {
+		t.Errorf("control API on tcp addresses should require a token")
+	}
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("hub-control-%d.sock", os.Getpid()))
+	listener, err := listenControlAPI("unix:"+socket, "")
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket. %s", err)
+	}
+	defer listener.Close()
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("only the current user should reach the unix socket. %v", fi.Mode())
+	}
+	// no tunnel is added through the unix socket
+	go http.Serve(listener, controlServer{newTunnelRegistry(nil), ""})
+	unixClient := http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}}}
+	if resp, err = unixClient.Get("http://localhost/tunnels"); err != nil || resp.StatusCode != 200 {
+		t.Errorf("failed to reach control API on unix socket. %v", err)
+	}
+}
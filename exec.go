@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhx71/hub/hublib"
+	"github.com/google/uuid"
+)
+
+// Remote commands run in a room of their own so their output does not go
+// through the control room. Once the client joined it and sent startCommand,
+// the agent streams stdout and stderr messages followed by one exit message.
+// The client may send cancelCommand to kill the command.
+
+// allowedCommands holds the programs the agent may run for clients. The
+// agent refuses every command when empty.
+var allowedCommands = make(map[string]bool)
+
+// splitCommandLine splits s on spaces, keeping single or double quoted parts together.
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command %s", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+// runCommand runs args on behalf of a client and streams its output to a
+// new command room.
+func runCommand(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, args []string, refid, peerPublic string) {
+	returnFailure := func(cause string) {
+		controlRoom.WriteJSON(agentResponse{
+			Type:  "commandFailed",
+			Refid: refid,
+			Cause: cause})
+	}
+	if len(args) == 0 || !allowedCommands[args[0]] {
+		log.Println("agent | refusing to run command", args)
+		returnFailure(fmt.Sprintf("command %v is not allowed on agent", args))
+		return
+	}
+	commandRoom := uuid.New().String()
+	commandPassword := uuid.New().String()
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, commandRoom, commandPassword, kp, peerPublic, false)
+	if err != nil {
+		log.Println("agent |", commandRoom, "failed to create room for command", err)
+		returnFailure("failed to create room for command")
+		return
+	}
+	defer roomConn.Close()
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "commandRoomCreated",
+		Refid:     refid,
+		Room:      commandRoom,
+		Password:  commandPassword,
+		Success:   true,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", commandRoom, "Failed to send commandRoomCreated message to client")
+		return
+	}
+
+	// output is only streamed once the client is in the room
+	timer := time.AfterFunc(30*time.Second, func() { roomConn.Close() })
+	var start agentRequest
+	err = roomConn.ReadJSON(&start)
+	timer.Stop()
+	if err != nil || start.Type != "startCommand" {
+		log.Println("agent |", commandRoom, "client did not start command.", err)
+		return
+	}
+	defer trackTunnel()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			var req agentRequest
+			if err := roomConn.ReadJSON(&req); err != nil {
+				// nobody reads the output once the client is gone
+				cancel()
+				return
+			}
+			if req.Type == "cancelCommand" {
+				log.Println("agent |", commandRoom, "client canceled command", args)
+				cancel()
+			}
+		}
+	}()
+
+	log.Println("agent |", commandRoom, "running command", args)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	exit := agentResponse{Type: "exit", Refid: refid}
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		var stderr io.ReadCloser
+		stderr, err = cmd.StderrPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err == nil {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go streamOutput(roomConn, "stdout", refid, stdout, cancel, &wg)
+			go streamOutput(roomConn, "stderr", refid, stderr, cancel, &wg)
+			// pipes must be drained before waiting for the command
+			wg.Wait()
+			err = cmd.Wait()
+		}
+	}
+	if err != nil {
+		exit.Cause = err.Error()
+		exit.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exit.ExitCode = exitErr.ExitCode()
+		}
+	}
+	if ctx.Err() != nil {
+		exit.Cause = "command canceled"
+	}
+	exit.Success = err == nil
+	log.Println("agent |", commandRoom, "command", args, "exited with code", exit.ExitCode, exit.Cause)
+	roomConn.WriteJSON(exit)
+}
+
+// streamOutput sends what the command writes to r as messages of type mt.
+// It stops and cancels the command once the messages can't be sent anymore.
+func streamOutput(roomConn *hublib.Room, mt, refid string, r io.Reader, cancel context.CancelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := roomConn.WriteJSON(agentResponse{Type: mt, Refid: refid, Data: buf[:n]}); err != nil {
+				log.Println("agent | failed to send command", mt, "canceling command.", err)
+				cancel()
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// runRemoteCommand asks an agent to run args, waiting up to timeout for its
+// answer, and copies its output to stdout and stderr. The command is canceled
+// when ctx is done. It returns the exit code of the command.
+func runRemoteCommand(ctx context.Context, hubClient *hublib.Client, dispatcher *controlDispatcher, timeout time.Duration, args []string, stdout, stderr io.Writer) (int, error) {
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{
+		Type:      "runCommand",
+		Command:   args,
+		PublicKey: publicKey(kp)}, timeout)
+	if err != nil {
+		return -1, err
+	}
+	if resp.Type != "commandRoomCreated" {
+		return -1, fmt.Errorf("agent refused to run command. cause: %s", resp.Cause)
+	}
+	commandRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		return -1, fmt.Errorf("failed to join command room. %s", err)
+	}
+	defer commandRoom.Close()
+	err = commandRoom.WriteJSON(agentRequest{Type: "startCommand", Refid: resp.Refid})
+	if err != nil {
+		return -1, fmt.Errorf("failed to start command. %s", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			commandRoom.WriteJSON(agentRequest{Type: "cancelCommand", Refid: resp.Refid})
+		case <-done:
+		}
+	}()
+	for {
+		var msg agentResponse
+		err = commandRoom.ReadJSON(&msg)
+		if err != nil {
+			return -1, fmt.Errorf("lost command output. %s", err)
+		}
+		switch msg.Type {
+		case "stdout":
+			stdout.Write(msg.Data)
+		case "stderr":
+			stderr.Write(msg.Data)
+		case "exit":
+			if len(msg.Cause) > 0 && msg.ExitCode == -1 {
+				return msg.ExitCode, fmt.Errorf("command failed. cause: %s", msg.Cause)
+			}
+			return msg.ExitCode, nil
+		}
+	}
+}
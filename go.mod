@@ -8,4 +8,5 @@ require (
 	github.com/mattn/go-ieproxy v0.0.1
 	github.com/tebeka/atexit v0.3.0
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+	golang.org/x/sys v0.0.0-20191112214154-59a1497f0cea
 )
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// prefixedConn is a net.Conn reading from r before the connection itself,
+// so bytes already buffered while parsing a request are not lost.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn *prefixedConn) Read(p []byte) (int, error) {
+	return conn.r.Read(p)
+}
+
+// proxyDestination returns the host:port a proxy request must be forwarded to.
+func proxyDestination(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", fmt.Errorf("invalid CONNECT destination %q", req.Host)
+		}
+		return req.Host, nil
+	}
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		return "", fmt.Errorf("proxy requests must use an absolute http URI. got %q", req.RequestURI)
+	}
+	port := req.URL.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port), nil
+}
+
+// originRequest serializes an absolute-URI proxy request as the origin server
+// expects it. Connection is closed after the response since following
+// requests on the client connection may target other hosts.
+func originRequest(req *http.Request) ([]byte, error) {
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	var buf bytes.Buffer
+	err := req.Write(&buf)
+	return buf.Bytes(), err
+}
+
+func writeProxyError(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
@@ -0,0 +1,81 @@
+package hublib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// RoomStatus describes a room as reported by the admin API.
+type RoomStatus struct {
+	Name             string
+	Created          time.Time
+	ParticipantCount int
+	Participants     []ParticipantStatus
+}
+
+// ParticipantStatus describes one websocket connection inside a room.
+type ParticipantStatus struct {
+	RemoteAddr string
+	Joined     time.Time
+	BytesRecv  int64 // bytes received by the hub from this participant
+	BytesSent  int64 // bytes relayed by the hub to this participant
+	Dropped    int64 // messages dropped because the participant queue was full
+}
+
+type roomsResponse struct {
+	Rooms []RoomStatus
+}
+
+// Rooms returns a snapshot of every room currently open on the hub.
+func (hub *Hub) Rooms() []RoomStatus {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	status := make([]RoomStatus, 0, len(hub.rooms))
+	for _, room := range hub.rooms {
+		room.lock.Lock()
+		rs := RoomStatus{
+			Name:             room.name,
+			Created:          room.created,
+			ParticipantCount: len(room.participants),
+			Participants:     make([]ParticipantStatus, 0, len(room.participants)),
+		}
+		for _, p := range room.participants {
+			rs.Participants = append(rs.Participants, ParticipantStatus{
+				RemoteAddr: p.conn.RemoteAddr().String(),
+				Joined:     p.joined,
+				BytesRecv:  atomic.LoadInt64(&p.bytesRecv),
+				BytesSent:  atomic.LoadInt64(&p.bytesSent),
+				Dropped:    atomic.LoadInt64(&p.dropped),
+			})
+		}
+		room.lock.Unlock()
+		status = append(status, rs)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Created.Before(status[j].Created) })
+	return status
+}
+
+// ServeAdmin lists the hub rooms as JSON. Callers must provide
+// HubOptions.AdminToken in the x-token header.
+func (hub *Hub) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	token := hub.opts.AdminToken
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(r.Header.Get("x-token")), []byte(token)) != 1 || !hub.verifiedClient(r) {
+		w.WriteHeader(401)
+		log.Println("admin | invalid token provided by", r.RemoteAddr)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(roomsResponse{hub.Rooms()})
+	if err != nil {
+		log.Println("admin | failed to write rooms list:", err)
+	}
+}
@@ -1,11 +1,18 @@
 package hublib
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/mattn/go-ieproxy"
@@ -13,11 +20,49 @@ import (
 
 type Client struct {
 	hubUrl, token string
+	dialer        *websocket.Dialer
+	header        http.Header
+}
+
+// ClientOptions configures how a Client connects to the hub.
+type ClientOptions struct {
+	// Token is provided in the x-token header when joining rooms.
+	Token string
+	// Proxy returns the proxy used to reach the hub. System proxy settings
+	// are used when nil, unless BypassProxy is set.
+	Proxy func(*http.Request) (*url.URL, error)
+	// BypassProxy connects directly to the hub when Proxy is nil.
+	BypassProxy bool
+	// TLSConfig is used to connect to wss:// hubs. Default configuration when nil.
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds the websocket handshake. 45 seconds when 0.
+	HandshakeTimeout time.Duration
+	// ReadBufferSize and WriteBufferSize are the websocket buffer sizes.
+	// 4096 bytes when 0.
+	ReadBufferSize, WriteBufferSize int
+	// Header is added to the websocket handshake of every room joined.
+	Header http.Header
 }
 
 type Room struct {
 	room, password string
 	conn           *websocket.Conn
+	writeLock      sync.Mutex     // serializes writes to conn and protects secure
+	secure         *secureChannel // nil unless end-to-end encryption is enabled
+	broken         int32          // set once reading or writing the websocket failed
+
+	deadlineLock sync.Mutex // protects the read deadlines below
+	readDeadline time.Time  // set while reading with a context, zero when none
+	pongDeadline time.Time  // extended by pongs, zero unless the room is pinged
+}
+
+// JoinError is returned when the hub refuses to let a participant enter a room.
+type JoinError struct {
+	Room, Cause string
+}
+
+func (err *JoinError) Error() string {
+	return fmt.Sprintf("could not enter room. cause: %s", err.Cause)
 }
 
 type hubRequest struct {
@@ -30,46 +75,80 @@ type hubResponse struct {
 	Cause   string
 }
 
+// NewClient creates a client using proxy, when not empty, or the system
+// proxy unless bypassproxy is set.
 func NewClient(hubUrl, token string, bypassproxy bool, proxy string) *Client {
-	if !bypassproxy && len(proxy) == 0 {
-		websocket.DefaultDialer = &websocket.Dialer{
-			Proxy: ieproxy.GetProxyFunc()}
-	} else if len(proxy) > 0 {
+	opts := ClientOptions{Token: token, BypassProxy: bypassproxy}
+	if len(proxy) > 0 {
 		u, err := url.Parse(proxy)
 		if err != nil {
 			log.Printf("failed to parse proxy URL. %s\n", err)
 		} else {
-			websocket.DefaultDialer = &websocket.Dialer{
-				Proxy: http.ProxyURL(u)}
+			opts.Proxy = http.ProxyURL(u)
 		}
 	}
-	return &Client{hubUrl, token}
+	return NewClientWithOptions(hubUrl, opts)
+}
+
+// NewClientWithOptions creates a client with its own websocket dialer so
+// clients with different settings can live in the same process.
+func NewClientWithOptions(hubUrl string, opts ClientOptions) *Client {
+	proxy := opts.Proxy
+	if proxy == nil && !opts.BypassProxy {
+		proxy = ieproxy.GetProxyFunc()
+	}
+	handshakeTimeout := opts.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = 45 * time.Second
+	}
+	return &Client{
+		hubUrl: hubUrl,
+		token:  opts.Token,
+		dialer: &websocket.Dialer{
+			Proxy:            proxy,
+			TLSClientConfig:  opts.TLSConfig,
+			HandshakeTimeout: handshakeTimeout,
+			ReadBufferSize:   opts.ReadBufferSize,
+			WriteBufferSize:  opts.WriteBufferSize,
+		},
+		header: opts.Header,
+	}
+}
+
+func (client *Client) Join(room, password string) (*Room, error) {
+	return client.JoinContext(context.Background(), room, password)
 }
 
-func (client *Client) Join(room, password string) (roomInfo *Room, err error) {
-	roomInfo = &Room{room, password, nil}
+// JoinContext joins room, giving up when ctx is done before the hub let the
+// participant in. Failures are *JoinError or *OpError values.
+func (client *Client) JoinContext(ctx context.Context, room, password string) (roomInfo *Room, err error) {
+	roomInfo = &Room{room: room, password: password}
 	log.Println("hubclt| entering room", room)
 	hdrs := make(http.Header)
+	for k, v := range client.header {
+		hdrs[k] = v
+	}
 	hdrs["x-token"] = []string{client.token}
-	roomInfo.conn, _, err = websocket.DefaultDialer.Dial(client.hubUrl, hdrs)
+	var httpResp *http.Response
+	roomInfo.conn, httpResp, err = client.dialer.DialContext(ctx, client.hubUrl, hdrs)
 	if err != nil {
-		return nil, err
+		return nil, opError(ctx, "join", room, err, httpResp)
 	}
 	log.Println("hubclt| connected to hub")
-	err = roomInfo.WriteJSON(hubRequest{"join", room, password})
+	err = roomInfo.WriteJSONContext(ctx, hubRequest{"join", room, password})
 	if err != nil {
 		roomInfo.Close()
-		return nil, fmt.Errorf("failed to send join msg: %s", err)
+		return nil, opError(ctx, "join", room, fmt.Errorf("failed to send join msg: %w", err), nil)
 	}
 	var resp hubResponse
-	err = roomInfo.ReadJSON(&resp)
+	err = roomInfo.ReadJSONContext(ctx, &resp)
 	if err != nil {
 		roomInfo.Close()
-		return nil, fmt.Errorf("failed to read join confirmation msg: %s", err)
+		return nil, opError(ctx, "join", room, fmt.Errorf("failed to read join confirmation msg: %w", err), nil)
 	}
 	if !resp.Success {
 		roomInfo.Close()
-		return nil, fmt.Errorf("could not enter room. cause: %s", resp.Cause)
+		return nil, &JoinError{room, resp.Cause}
 	}
 	return roomInfo, nil
 }
@@ -81,12 +160,39 @@ func (roomInfo *Room) Close() error {
 }
 
 func (roomInfo *Room) WriteJSON(v interface{}) error {
+	return roomInfo.WriteJSONContext(context.Background(), v)
+}
+
+// WriteJSONContext sends v to the room, giving up when ctx is done first.
+// The room is unusable after an interrupted write.
+func (roomInfo *Room) WriteJSONContext(ctx context.Context, v interface{}) error {
 	log.Printf("hubclt| Sending JSON %v to room: %s\n", v, roomInfo.room)
-	return roomInfo.conn.WriteJSON(v)
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = roomInfo.writeMessageContext(ctx, websocket.TextMessage, p)
+	if err != nil {
+		return opError(ctx, "write", roomInfo.room, err, nil)
+	}
+	return nil
 }
 
 func (roomInfo *Room) ReadJSON(v interface{}) error {
-	err := roomInfo.conn.ReadJSON(v)
+	return roomInfo.ReadJSONContext(context.Background(), v)
+}
+
+// ReadJSONContext reads the next JSON message of the room, giving up when
+// ctx is done first. The room is unusable after an interrupted read.
+func (roomInfo *Room) ReadJSONContext(ctx context.Context, v interface{}) error {
+	stop := roomInfo.watchContext(ctx, roomInfo.setReadDeadline, roomInfo.setReadDeadline)
+	_, p, err := roomInfo.readMessage()
+	stop()
+	if err != nil && roomInfo.isBroken() {
+		err = opError(ctx, "read", roomInfo.room, err, nil)
+	} else if err == nil {
+		err = json.Unmarshal(p, v)
+	}
 	if err != nil {
 		log.Printf("hubclt| Error while reading from room %s. Err:%s", roomInfo.room, err)
 		return err
@@ -95,6 +201,9 @@ func (roomInfo *Room) ReadJSON(v interface{}) error {
 	return nil
 }
 
+// Relay copies data between the room and netConn until one side fails or
+// closes. The end of netConn is sent as an empty message so a peer using
+// Relay or RoomConn closes its side too.
 func (roomInfo *Room) Relay(netConn net.Conn) error {
 	doClose := func() {
 		log.Println("hubclt| closing room and net conn")
@@ -103,12 +212,17 @@ func (roomInfo *Room) Relay(netConn net.Conn) error {
 	}
 	go func() {
 		for {
-			_, p, err := roomInfo.conn.ReadMessage()
+			_, p, err := roomInfo.readMessage()
 			if err != nil {
 				log.Printf("hubclt| failed to read data from room. Closing tunnel (room: %s). Err: %s\n", roomInfo.room, err)
 				doClose()
 				return
 			}
+			if len(p) == 0 {
+				log.Printf("hubclt| peer closed tunnel (room: %s)\n", roomInfo.room)
+				doClose()
+				return
+			}
 			log.Printf("hubclt| read %d bytes from room\n", len(p))
 			n, err := netConn.Write(p)
 			if err != nil {
@@ -124,11 +238,12 @@ func (roomInfo *Room) Relay(netConn net.Conn) error {
 		n, err := netConn.Read(buf)
 		if err != nil {
 			log.Printf("hubclt| failed to read data from tcp connection %s. Closing tunnel (room: %s). Err: %s\n", netConn.RemoteAddr().String(), roomInfo.room, err)
+			roomInfo.writeMessage(websocket.BinaryMessage, nil)
 			doClose()
 			return err
 		}
 		log.Printf("hubclt| read %d bytes from tcp connection\n", n)
-		err = roomInfo.conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+		err = roomInfo.writeMessage(websocket.BinaryMessage, buf[:n])
 		if err != nil {
 			log.Printf("hubclt| failed to write data to tunnel room %s. Closing tunnel. Err: %s\n", roomInfo.room, err)
 			doClose()
@@ -138,6 +253,223 @@ func (roomInfo *Room) Relay(netConn net.Conn) error {
 	}
 }
 
+// writeMessage sends a message to the room, encrypted when enabled.
+// It is safe to call from many goroutines.
+func (roomInfo *Room) writeMessage(mt int, p []byte) error {
+	return roomInfo.writeMessageContext(context.Background(), mt, p)
+}
+
+func (roomInfo *Room) writeMessageContext(ctx context.Context, mt int, p []byte) error {
+	roomInfo.writeLock.Lock()
+	defer roomInfo.writeLock.Unlock()
+	// the deadline of the websocket is only changed while holding the lock,
+	// cancellation interrupts the write through the underlying connection
+	stop := roomInfo.watchContext(ctx, roomInfo.conn.SetWriteDeadline, roomInfo.conn.UnderlyingConn().SetWriteDeadline)
+	defer stop()
+	var err error
+	if roomInfo.secure != nil {
+		err = roomInfo.conn.WriteMessage(websocket.BinaryMessage, roomInfo.secure.seal(mt, p))
+	} else {
+		err = roomInfo.conn.WriteMessage(mt, p)
+	}
+	if err != nil {
+		atomic.StoreInt32(&roomInfo.broken, 1)
+	}
+	return err
+}
+
+// readMessage returns the next message from the room, decrypted when enabled.
+func (roomInfo *Room) readMessage() (int, []byte, error) {
+	mt, p, err := roomInfo.conn.ReadMessage()
+	if err != nil {
+		atomic.StoreInt32(&roomInfo.broken, 1)
+		return mt, p, err
+	}
+	roomInfo.writeLock.Lock()
+	secure := roomInfo.secure
+	roomInfo.writeLock.Unlock()
+	if secure == nil {
+		return mt, p, nil
+	}
+	return secure.open(p)
+}
+
+// watchContext applies the deadline of ctx with setDeadline and interrupts
+// the pending read or write with interrupt when ctx is canceled, until stop
+// is called.
+func (roomInfo *Room) watchContext(ctx context.Context, setDeadline, interrupt func(time.Time) error) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			interrupt(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		setDeadline(time.Time{})
+	}
+}
+
+// setReadDeadline sets the read deadline of the websocket to t, or to the
+// time pongs must come by when earlier.
+func (roomInfo *Room) setReadDeadline(t time.Time) error {
+	roomInfo.deadlineLock.Lock()
+	defer roomInfo.deadlineLock.Unlock()
+	roomInfo.readDeadline = t
+	return roomInfo.applyReadDeadline()
+}
+
+// keepAlive breaks the websocket when no pong comes for timeout. Pongs are
+// only read while some goroutine reads the room.
+func (roomInfo *Room) keepAlive(timeout time.Duration) {
+	roomInfo.deadlineLock.Lock()
+	roomInfo.pongDeadline = time.Now().Add(timeout)
+	roomInfo.applyReadDeadline()
+	roomInfo.deadlineLock.Unlock()
+	roomInfo.conn.SetPongHandler(func(string) error {
+		roomInfo.deadlineLock.Lock()
+		defer roomInfo.deadlineLock.Unlock()
+		roomInfo.pongDeadline = time.Now().Add(timeout)
+		return roomInfo.applyReadDeadline()
+	})
+}
+
+// applyReadDeadline sets the earliest read deadline on the websocket.
+// Caller must hold deadlineLock.
+func (roomInfo *Room) applyReadDeadline() error {
+	deadline := roomInfo.readDeadline
+	if !roomInfo.pongDeadline.IsZero() && (deadline.IsZero() || roomInfo.pongDeadline.Before(deadline)) {
+		deadline = roomInfo.pongDeadline
+	}
+	return roomInfo.conn.SetReadDeadline(deadline)
+}
+
+// isBroken tells whether the websocket of the room failed. Messages can no
+// longer go through and the room must be joined again.
+func (roomInfo *Room) isBroken() bool {
+	return atomic.LoadInt32(&roomInfo.broken) == 1
+}
+
 func (roomInfo *Room) RemoteAddr() string {
 	return roomInfo.conn.RemoteAddr().String()
 }
+
+// Pipe copies data between a and b in both directions until one side
+// fails or reaches EOF, then closes both.
+func Pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		n, err := io.Copy(dst, src)
+		log.Printf("hubclt| relayed %d bytes from %s to %s. Err: %v\n", n, src.RemoteAddr(), dst.RemoteAddr(), err)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// WriteDatagram sends p as one binary message to the room.
+func (roomInfo *Room) WriteDatagram(p []byte) error {
+	return roomInfo.writeMessage(websocket.BinaryMessage, p)
+}
+
+// ReadDatagram returns the next binary message from the room.
+func (roomInfo *Room) ReadDatagram() ([]byte, error) {
+	for {
+		mt, p, err := roomInfo.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if mt == websocket.BinaryMessage {
+			return p, nil
+		}
+	}
+}
+
+// RelayUDP relays datagrams between the room and a connected UDP socket,
+// one websocket message per datagram. Both are closed once no datagram went
+// through for idleTimeout, a minute when not positive.
+func (roomInfo *Room) RelayUDP(udpConn *net.UDPConn, idleTimeout time.Duration) error {
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+	checkInterval := idleTimeout / 2
+	if checkInterval <= 0 {
+		checkInterval = idleTimeout
+	}
+	var lastActive int64
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	doClose := func() {
+		closeOnce.Do(func() {
+			log.Println("hubclt| closing room and udp conn")
+			close(done)
+			roomInfo.Close()
+			udpConn.Close()
+		})
+	}
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) > idleTimeout {
+					log.Printf("hubclt| udp flow idle for %s. Closing tunnel (room: %s)\n", idleTimeout, roomInfo.room)
+					doClose()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			p, err := roomInfo.ReadDatagram()
+			if err != nil {
+				log.Printf("hubclt| failed to read datagram from room. Closing tunnel (room: %s). Err: %s\n", roomInfo.room, err)
+				doClose()
+				return
+			}
+			touch()
+			_, err = udpConn.Write(p)
+			if err != nil {
+				log.Printf("hubclt| failed to write datagram to udp conn. Closing tunnel (room: %s). Err: %s\n", roomInfo.room, err)
+				doClose()
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			log.Printf("hubclt| failed to read datagram from udp conn. Closing tunnel (room: %s). Err: %s\n", roomInfo.room, err)
+			doClose()
+			return err
+		}
+		touch()
+		err = roomInfo.WriteDatagram(buf[:n])
+		if err != nil {
+			log.Printf("hubclt| failed to write datagram to tunnel room %s. Closing tunnel. Err: %s\n", roomInfo.room, err)
+			doClose()
+			return err
+		}
+	}
+}
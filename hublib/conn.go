@@ -0,0 +1,216 @@
+package hublib
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RoomConn is a byte stream over a room joined by two peers. It implements
+// net.Conn so protocols like HTTP or TLS can run directly over the hub.
+//
+// Data goes as binary messages, compatible with Room.Relay on the other
+// side. An empty binary message tells the peer the stream was closed.
+type RoomConn struct {
+	room     *Room
+	messages chan []byte // filled by readLoop, closed once the room fails
+
+	lock          sync.Mutex // protects the fields below
+	pending       []byte     // rest of the message being read
+	readErr       error      // why messages was closed
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadline is signaled whenever readDeadline changes
+	deadline chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewRoomConn turns room into a net.Conn. Nothing else may read the room afterward.
+func NewRoomConn(room *Room) *RoomConn {
+	conn := &RoomConn{
+		room:     room,
+		messages: make(chan []byte, 16),
+		deadline: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go conn.readLoop()
+	return conn
+}
+
+// readLoop runs apart from Read so read deadlines never interrupt the websocket.
+func (conn *RoomConn) readLoop() {
+	defer close(conn.messages)
+	for {
+		mt, p, err := conn.room.readMessage()
+		if err != nil && !conn.room.isBroken() {
+			log.Printf("hubclt| ignoring message of room %s. Err: %s\n", conn.room.room, err)
+			continue
+		}
+		if err == nil && mt == websocket.BinaryMessage && len(p) == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				err = io.EOF
+			}
+			conn.lock.Lock()
+			conn.readErr = err
+			conn.lock.Unlock()
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		select {
+		case conn.messages <- p:
+		case <-conn.closed:
+			return
+		}
+	}
+}
+
+func (conn *RoomConn) Read(p []byte) (int, error) {
+	for {
+		conn.lock.Lock()
+		if len(conn.pending) > 0 {
+			n := copy(p, conn.pending)
+			conn.pending = conn.pending[n:]
+			conn.lock.Unlock()
+			return n, nil
+		}
+		deadline := conn.readDeadline
+		conn.lock.Unlock()
+		msg, err := conn.next(deadline)
+		if err != nil {
+			return 0, err
+		}
+		conn.lock.Lock()
+		conn.pending = msg
+		conn.lock.Unlock()
+	}
+}
+
+// next waits for the next message until deadline expires. It returns no
+// message and no error when the read deadline changed meanwhile.
+func (conn *RoomConn) next(deadline time.Time) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case msg, ok := <-conn.messages:
+		if ok {
+			return msg, nil
+		}
+		if conn.isClosed() {
+			return nil, ErrRoomClosed
+		}
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		return nil, conn.readErr
+	case <-timeout:
+		return nil, timeoutError{}
+	case <-conn.deadline:
+		return nil, nil
+	case <-conn.closed:
+		return nil, ErrRoomClosed
+	}
+}
+
+func (conn *RoomConn) Write(p []byte) (int, error) {
+	if conn.isClosed() {
+		return 0, ErrRoomClosed
+	}
+	conn.lock.Lock()
+	deadline := conn.writeDeadline
+	conn.lock.Unlock()
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		if time.Until(deadline) <= 0 {
+			return 0, timeoutError{}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		err := conn.room.writeMessageContext(ctx, websocket.BinaryMessage, p[written:written+n])
+		if err != nil {
+			if ctx.Err() != nil {
+				return written, timeoutError{}
+			}
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close tells the peer the stream ended and leaves the room.
+func (conn *RoomConn) Close() error {
+	err := ErrRoomClosed
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.room.writeMessage(websocket.BinaryMessage, nil)
+		err = conn.room.Close()
+	})
+	return err
+}
+
+func (conn *RoomConn) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *RoomConn) LocalAddr() net.Addr {
+	return conn.room.conn.LocalAddr()
+}
+
+func (conn *RoomConn) RemoteAddr() net.Addr {
+	return conn.room.conn.RemoteAddr()
+}
+
+func (conn *RoomConn) SetDeadline(t time.Time) error {
+	conn.SetWriteDeadline(t)
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *RoomConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	conn.readDeadline = t
+	conn.lock.Unlock()
+	select {
+	case conn.deadline <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (conn *RoomConn) SetWriteDeadline(t time.Time) error {
+	conn.lock.Lock()
+	conn.writeDeadline = t
+	conn.lock.Unlock()
+	return nil
+}
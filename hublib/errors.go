@@ -0,0 +1,74 @@
+package hublib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Kinds of failures reported by the hub client. Use errors.Is to tell them
+// apart, whatever the operation that failed.
+var (
+	// ErrTimeout means the context deadline or a network timeout expired.
+	ErrTimeout = errors.New("timeout")
+	// ErrAuth means the hub refused the token or the room password.
+	ErrAuth = errors.New("authentication failed")
+	// ErrHubUnavailable means the hub could not be reached or the connection to it was lost.
+	ErrHubUnavailable = errors.New("hub unavailable")
+)
+
+// OpError tells which operation on which room failed and why.
+type OpError struct {
+	Op   string // "join", "read" or "write"
+	Room string
+	Kind error // ErrTimeout, ErrAuth, ErrHubUnavailable or context.Canceled
+	Err  error // underlying error
+}
+
+func (err *OpError) Error() string {
+	if err.Err == nil || err.Err == err.Kind {
+		return fmt.Sprintf("%s room %s: %s", err.Op, err.Room, err.Kind)
+	}
+	return fmt.Sprintf("%s room %s: %s: %s", err.Op, err.Room, err.Kind, err.Err)
+}
+
+func (err *OpError) Unwrap() error {
+	return err.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (err *OpError) Is(target error) bool {
+	return target == err.Kind
+}
+
+// Timeout lets OpError be checked like a net.Error.
+func (err *OpError) Timeout() bool {
+	return err.Kind == ErrTimeout
+}
+
+// Is reports that a refused join is an authentication failure.
+func (err *JoinError) Is(target error) bool {
+	return target == ErrAuth
+}
+
+// opError classifies err, returned by op on room while ctx was in effect.
+// resp is the hub answer to the websocket handshake, when any.
+func opError(ctx context.Context, op, room string, err error, resp *http.Response) error {
+	var kind error
+	var netErr net.Error
+	switch {
+	case resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		kind = ErrAuth
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		kind = ErrTimeout
+	case ctx.Err() != nil:
+		kind = ctx.Err()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		kind = ErrTimeout
+	default:
+		kind = ErrHubUnavailable
+	}
+	return &OpError{op, room, kind, err}
+}
@@ -0,0 +1,491 @@
+package hublib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames exchanged on a multiplexed room. Every frame is one binary websocket
+// message made of a 1 byte type, a 4 bytes big endian stream id and a payload.
+const (
+	frameOpen     byte = iota + 1 // payload: target the peer should connect to
+	frameOpenAck                  // no payload
+	frameOpenFail                 // payload: cause
+	frameData                     // payload: data
+	frameClose                    // no payload
+	frameWindow                   // payload: 4 bytes window increment
+)
+
+const (
+	frameHeaderLen = 5
+	// maxFramePayload is the largest data payload sent in one frame.
+	maxFramePayload = 32 * 1024
+	// StreamWindow is the number of bytes a stream sender may have in flight
+	// before the receiver acknowledges them.
+	StreamWindow = 256 * 1024
+)
+
+var (
+	// ErrSessionClosed is returned when using a closed multiplexed session.
+	ErrSessionClosed = errors.New("multiplexed session closed")
+	// ErrStreamClosed is returned when using a closed stream.
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session carries many logical streams over a single room. Exactly two peers
+// must be in the room: one created with client set to true, the other false.
+type Session struct {
+	room      *Room
+	writeLock sync.Mutex
+	lock      sync.Mutex // protects streams, nextID and err
+	streams   map[uint32]*Stream
+	nextID    uint32
+	accept    chan *Stream
+	done      chan struct{}
+	err       error
+}
+
+// NewSession starts multiplexing streams over room. Client side streams get
+// odd ids and agent side streams even ids so both peers can open streams.
+func NewSession(room *Room, client bool) *Session {
+	session := &Session{
+		room:    room,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, 16),
+		done:    make(chan struct{}),
+	}
+	if client {
+		session.nextID = 1
+	}
+	go session.readLoop()
+	return session
+}
+
+// Open asks the peer to open a stream connected to target and waits for its answer.
+func (session *Session) Open(target string) (*Stream, error) {
+	return session.OpenContext(context.Background(), target)
+}
+
+// OpenContext is like Open but gives up waiting for the peer answer when ctx
+// is done first. The peer is then told to close the stream.
+func (session *Session) OpenContext(ctx context.Context, target string) (*Stream, error) {
+	session.lock.Lock()
+	if session.err != nil {
+		session.lock.Unlock()
+		return nil, session.err
+	}
+	id := session.nextID
+	session.nextID += 2
+	stream := newStream(session, id, target)
+	session.streams[id] = stream
+	session.lock.Unlock()
+
+	err := session.writeFrame(frameOpen, id, []byte(target))
+	if err != nil {
+		session.removeStream(id)
+		return nil, err
+	}
+	select {
+	case err = <-stream.opened:
+	case <-session.done:
+		err = session.Err()
+	case <-ctx.Done():
+		session.removeStream(id)
+		// the peer may accept the stream after we gave up
+		session.writeFrame(frameClose, id, nil)
+		return nil, opError(ctx, "open", session.room.room, ctx.Err(), nil)
+	}
+	if err != nil {
+		session.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a stream. The caller must answer with
+// Stream.Ack or Stream.Reject. Streams the peer opens while 16 of them wait
+// to be accepted are rejected.
+func (session *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-session.accept:
+		return stream, nil
+	case <-session.done:
+		return nil, session.Err()
+	}
+}
+
+// Close closes every stream and the underlying room.
+func (session *Session) Close() error {
+	session.shutdown(ErrSessionClosed)
+	return session.room.Close()
+}
+
+// Done is closed when the session is closed.
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+// Err returns the reason the session closed, nil while it is open.
+func (session *Session) Err() error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.err
+}
+
+func (session *Session) shutdown(err error) {
+	session.lock.Lock()
+	if session.err != nil {
+		session.lock.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = make(map[uint32]*Stream)
+	close(session.done)
+	session.lock.Unlock()
+	for _, stream := range streams {
+		stream.remoteClose()
+	}
+}
+
+func (session *Session) writeFrame(ft byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderLen+len(payload))
+	frame[0] = ft
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[frameHeaderLen:], payload)
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	err := session.room.writeMessage(websocket.BinaryMessage, frame)
+	if err != nil {
+		session.shutdown(err)
+	}
+	return err
+}
+
+func (session *Session) stream(id uint32) *Stream {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.streams[id]
+}
+
+func (session *Session) removeStream(id uint32) {
+	session.lock.Lock()
+	delete(session.streams, id)
+	session.lock.Unlock()
+}
+
+func (session *Session) readLoop() {
+	for {
+		_, frame, err := session.room.readMessage()
+		if err != nil {
+			log.Printf("hubclt| failed to read from multiplexed room %s. Err: %s\n", session.room.room, err)
+			session.shutdown(err)
+			return
+		}
+		if len(frame) < frameHeaderLen {
+			log.Printf("hubclt| ignoring short frame of %d bytes in room %s\n", len(frame), session.room.room)
+			continue
+		}
+		ft, id, payload := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[frameHeaderLen:]
+		if ft == frameOpen {
+			session.lock.Lock()
+			if session.err != nil {
+				session.lock.Unlock()
+				return
+			}
+			// peer ids have the other parity and must not clash with an open stream
+			if id%2 == session.nextID%2 || session.streams[id] != nil {
+				session.lock.Unlock()
+				log.Printf("hubclt| rejecting stream %d of room %s. Invalid stream id\n", id, session.room.room)
+				go session.writeFrame(frameOpenFail, id, []byte("invalid stream id"))
+				continue
+			}
+			stream := newStream(session, id, string(payload))
+			session.streams[id] = stream
+			session.lock.Unlock()
+			// a slow acceptor must not stall the streams already open
+			select {
+			case session.accept <- stream:
+			default:
+				log.Printf("hubclt| rejecting stream %d of room %s. Too many streams waiting to be accepted\n", id, session.room.room)
+				go stream.Reject("too many streams waiting to be accepted")
+			}
+			continue
+		}
+		stream := session.stream(id)
+		if stream == nil {
+			continue
+		}
+		switch ft {
+		case frameOpenAck:
+			stream.answer(nil)
+		case frameOpenFail:
+			stream.answer(fmt.Errorf("could not open stream to %s. cause: %s", stream.target, payload))
+		case frameData:
+			if !stream.push(payload) {
+				log.Printf("hubclt| closing multiplexed room %s. Stream %d exceeded its window\n", session.room.room, id)
+				session.shutdown(fmt.Errorf("stream %d exceeded its window", id))
+				session.room.Close()
+				return
+			}
+		case frameWindow:
+			if len(payload) == 4 {
+				stream.addWindow(int64(binary.BigEndian.Uint32(payload)))
+			}
+		case frameClose:
+			session.removeStream(id)
+			stream.remoteClose()
+		}
+	}
+}
+
+// Stream is one logical connection of a Session. It implements net.Conn.
+type Stream struct {
+	session *Session
+	id      uint32
+	target  string
+	opened  chan error
+
+	lock          sync.Mutex
+	buf           bytes.Buffer
+	consumed      int64 // bytes read since last window update
+	sendWindow    int64
+	readDeadline  time.Time
+	writeDeadline time.Time
+	localClosed   bool
+	remoteClosed  bool
+	// readable and writable are signaled whenever the state above changes
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newStream(session *Session, id uint32, target string) *Stream {
+	return &Stream{
+		session:    session,
+		id:         id,
+		target:     target,
+		opened:     make(chan error, 1),
+		sendWindow: StreamWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// Target returns the destination requested by the peer that opened the stream.
+func (stream *Stream) Target() string {
+	return stream.target
+}
+
+// Ack tells the peer the stream is ready.
+func (stream *Stream) Ack() error {
+	return stream.session.writeFrame(frameOpenAck, stream.id, nil)
+}
+
+// Reject tells the peer the stream could not be opened.
+func (stream *Stream) Reject(cause string) error {
+	stream.session.removeStream(stream.id)
+	return stream.session.writeFrame(frameOpenFail, stream.id, []byte(cause))
+}
+
+func (stream *Stream) signal() {
+	for _, ch := range []chan struct{}{stream.readable, stream.writable} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// answer delivers the peer answer to Open. Duplicate answers are ignored.
+func (stream *Stream) answer(err error) {
+	select {
+	case stream.opened <- err:
+	default:
+	}
+}
+
+// push buffers data received from the peer. It returns false, buffering
+// nothing, when the peer sent more than the window it was granted: bytes
+// buffered or read but not acknowledged yet.
+func (stream *Stream) push(p []byte) bool {
+	stream.lock.Lock()
+	if int64(stream.buf.Len())+stream.consumed+int64(len(p)) > StreamWindow {
+		stream.lock.Unlock()
+		return false
+	}
+	stream.buf.Write(p)
+	stream.lock.Unlock()
+	stream.signal()
+	return true
+}
+
+func (stream *Stream) addWindow(n int64) {
+	stream.lock.Lock()
+	stream.sendWindow += n
+	stream.lock.Unlock()
+	stream.signal()
+}
+
+func (stream *Stream) remoteClose() {
+	stream.lock.Lock()
+	stream.remoteClosed = true
+	stream.lock.Unlock()
+	stream.signal()
+}
+
+// wait blocks until ch is signaled or deadline expires.
+// stream.lock must not be held.
+func wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+func (stream *Stream) Read(p []byte) (int, error) {
+	for {
+		stream.lock.Lock()
+		if stream.localClosed {
+			stream.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if stream.buf.Len() > 0 {
+			n, _ := stream.buf.Read(p)
+			stream.consumed += int64(n)
+			var increment int64
+			if stream.consumed >= StreamWindow/2 {
+				increment, stream.consumed = stream.consumed, 0
+			}
+			closed := stream.remoteClosed
+			stream.lock.Unlock()
+			if increment > 0 && !closed {
+				window := make([]byte, 4)
+				binary.BigEndian.PutUint32(window, uint32(increment))
+				stream.session.writeFrame(frameWindow, stream.id, window)
+			}
+			return n, nil
+		}
+		if stream.remoteClosed {
+			stream.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.lock.Unlock()
+		if err := wait(stream.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (stream *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		stream.lock.Lock()
+		if stream.localClosed || stream.remoteClosed {
+			stream.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		if stream.sendWindow <= 0 {
+			deadline := stream.writeDeadline
+			stream.lock.Unlock()
+			if err := wait(stream.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := int64(len(p) - written)
+		if n > stream.sendWindow {
+			n = stream.sendWindow
+		}
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		stream.sendWindow -= n
+		stream.lock.Unlock()
+		err := stream.session.writeFrame(frameData, stream.id, p[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// Close closes the stream on both ends. The underlying session stays open.
+func (stream *Stream) Close() error {
+	stream.lock.Lock()
+	if stream.localClosed {
+		stream.lock.Unlock()
+		return ErrStreamClosed
+	}
+	stream.localClosed = true
+	remoteClosed := stream.remoteClosed
+	stream.lock.Unlock()
+	stream.signal()
+	stream.session.removeStream(stream.id)
+	if remoteClosed {
+		return nil
+	}
+	return stream.session.writeFrame(frameClose, stream.id, nil)
+}
+
+func (stream *Stream) LocalAddr() net.Addr {
+	return stream.session.room.conn.LocalAddr()
+}
+
+func (stream *Stream) RemoteAddr() net.Addr {
+	return stream.session.room.conn.RemoteAddr()
+}
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.readDeadline, stream.writeDeadline = t, t
+	stream.lock.Unlock()
+	stream.signal()
+	return nil
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.readDeadline = t
+	stream.lock.Unlock()
+	stream.signal()
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.writeDeadline = t
+	stream.lock.Unlock()
+	stream.signal()
+	return nil
+}
@@ -0,0 +1,130 @@
+package hublib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy tells the hub what to do when a participant outbound queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the sender wait until the slow participant catches up.
+	// Only the sender's room is slowed down.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discards the message for the slow participant.
+	OverflowDrop
+	// OverflowDisconnect closes the slow participant connection.
+	OverflowDisconnect
+)
+
+// DefaultQueueSize is the outbound queue length used when HubOptions.QueueSize is 0.
+const DefaultQueueSize = 64
+
+// ParseOverflowPolicy converts "block", "drop" or "disconnect" to an OverflowPolicy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "block", "":
+		return OverflowBlock, nil
+	case "drop":
+		return OverflowDrop, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowDrop:
+		return "drop"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "block"
+}
+
+type outMessage struct {
+	mt   int
+	data []byte
+}
+
+type participant struct {
+	conn      *websocket.Conn
+	joined    time.Time
+	out       chan outMessage
+	done      chan struct{}
+	closeOnce sync.Once
+	bytesRecv int64
+	bytesSent int64
+	dropped   int64
+}
+
+func newParticipant(c *websocket.Conn, queueSize int) *participant {
+	return &participant{
+		conn:   c,
+		joined: time.Now(),
+		out:    make(chan outMessage, queueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// enqueue queues msg for the participant writer goroutine applying policy
+// when the queue is full. It never holds any lock.
+func (p *participant) enqueue(msg outMessage, policy OverflowPolicy) {
+	select {
+	case p.out <- msg:
+		return
+	case <-p.done:
+		return
+	default:
+	}
+	switch policy {
+	case OverflowDrop:
+		atomic.AddInt64(&p.dropped, 1)
+		log.Printf("hub   | outbound queue full. dropping %d bytes for participant %s\n", len(msg.data), p.conn.RemoteAddr().String())
+	case OverflowDisconnect:
+		log.Println("hub   | outbound queue full. disconnecting participant", p.conn.RemoteAddr().String())
+		p.close()
+	default:
+		select {
+		case p.out <- msg:
+		case <-p.done:
+		}
+	}
+}
+
+// writeLoop sends queued messages to the websocket until the participant is closed.
+func (p *participant) writeLoop(writeTimeout time.Duration) {
+	for {
+		select {
+		case msg := <-p.out:
+			if writeTimeout > 0 {
+				p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			err := p.conn.WriteMessage(msg.mt, msg.data)
+			if err != nil {
+				log.Println("hub   | failed to write to participant", p.conn.RemoteAddr().String(), err)
+				p.close()
+				return
+			}
+			atomic.AddInt64(&p.bytesSent, int64(len(msg.data)))
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// close stops the writer goroutine and closes the websocket so the reader
+// goroutine removes the participant from its room.
+func (p *participant) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
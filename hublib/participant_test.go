@@ -0,0 +1,155 @@
+package hublib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// more than the socket buffers of a participant hold
+	overflowMessages    = 200
+	overflowMessageSize = 128 * 1024
+)
+
+// overflowRoom starts a hub queuing 4 messages per participant and applying
+// policy, and joins one of its rooms with a sender, a participant reading
+// every message and a participant never reading until the test does.
+func overflowRoom(t *testing.T, policy OverflowPolicy) (sender, fast, slow *Room) {
+	srv := httptest.NewServer(NewHub(HubOptions{Token: "token", QueueSize: 4, Overflow: policy}))
+	t.Cleanup(srv.Close)
+	client := NewClient("ws"+strings.TrimPrefix(srv.URL, "http"), "token", true, "")
+	join := func() *Room {
+		room, err := client.Join("overflow", "password")
+		if err != nil {
+			t.Fatalf("failed to join room. %s", err)
+		}
+		t.Cleanup(func() { room.Close() })
+		return room
+	}
+	return join(), join(), join()
+}
+
+// sendMessages writes the numbered test messages, counting them in sent.
+// When acks is not nil, each message must be acknowledged before the next
+// one is sent, so a participant reading them never falls behind.
+func sendMessages(room *Room, sent *int32, acks <-chan int) error {
+	for i := 0; i < overflowMessages; i++ {
+		msg := make([]byte, overflowMessageSize)
+		binary.BigEndian.PutUint32(msg, uint32(i))
+		if err := room.writeMessage(websocket.BinaryMessage, msg); err != nil {
+			return err
+		}
+		atomic.AddInt32(sent, 1)
+		if acks != nil {
+			select {
+			case <-acks:
+			case <-time.After(5 * time.Second):
+				return fmt.Errorf("message #%d was not received", i)
+			}
+		}
+	}
+	return nil
+}
+
+// readMessages reads test messages until the last one or an error, counting
+// them in received and acknowledging them on acks when not nil. It fails the
+// test when messages come out of order.
+func readMessages(t *testing.T, room *Room, timeout time.Duration, received *int32, acks chan<- int) error {
+	last := -1
+	for last < overflowMessages-1 {
+		room.conn.SetReadDeadline(time.Now().Add(timeout))
+		_, msg, err := room.readMessage()
+		if err != nil {
+			return err
+		}
+		i := int(binary.BigEndian.Uint32(msg))
+		if i <= last {
+			t.Errorf("message #%d received after #%d", i, last)
+		}
+		last = i
+		atomic.AddInt32(received, 1)
+		if acks != nil {
+			acks <- i
+		}
+	}
+	return nil
+}
+
+func Test_OverflowDrop(t *testing.T) {
+	sender, fast, slow := overflowRoom(t, OverflowDrop)
+	var sent, fastReceived, slowReceived int32
+	acks := make(chan int, 1)
+	done := make(chan error, 1)
+	go func() { done <- readMessages(t, fast, 5*time.Second, &fastReceived, acks) }()
+	if err := sendMessages(sender, &sent, acks); err != nil {
+		t.Fatalf("failed to send messages. %s", err)
+	}
+	if err := <-done; err != nil || fastReceived != overflowMessages {
+		t.Errorf("participant reading should get every message. got %d, err: %v", fastReceived, err)
+	}
+	// messages beyond the queue and socket buffers are gone
+	err := readMessages(t, slow, 500*time.Millisecond, &slowReceived, nil)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("slow participant should stay connected. err: %v", err)
+	}
+	if slowReceived == 0 || slowReceived >= overflowMessages {
+		t.Errorf("slow participant should get the queued messages only. got %d of %d", slowReceived, overflowMessages)
+	}
+}
+
+func Test_OverflowDisconnect(t *testing.T) {
+	sender, fast, slow := overflowRoom(t, OverflowDisconnect)
+	var sent, fastReceived, slowReceived int32
+	acks := make(chan int, 1)
+	done := make(chan error, 1)
+	go func() { done <- readMessages(t, fast, 5*time.Second, &fastReceived, acks) }()
+	if err := sendMessages(sender, &sent, acks); err != nil {
+		t.Fatalf("failed to send messages. %s", err)
+	}
+	if err := <-done; err != nil || fastReceived != overflowMessages {
+		t.Errorf("participant reading should get every message. got %d, err: %v", fastReceived, err)
+	}
+	err := readMessages(t, slow, 5*time.Second, &slowReceived, nil)
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Errorf("hub should close the connection of the slow participant. err: %v", err)
+	}
+	if slowReceived >= overflowMessages {
+		t.Errorf("slow participant should not get every message. got %d", slowReceived)
+	}
+}
+
+func Test_OverflowBlock(t *testing.T) {
+	sender, fast, slow := overflowRoom(t, OverflowBlock)
+	var sent, fastReceived, slowReceived int32
+	sendDone := make(chan error, 1)
+	go func() { sendDone <- sendMessages(sender, &sent, nil) }()
+	fastDone := make(chan error, 1)
+	go func() { fastDone <- readMessages(t, fast, 10*time.Second, &fastReceived, nil) }()
+
+	// the slow participant holds the room back
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n >= overflowMessages {
+		t.Fatalf("sender should wait for the slow participant. sent %d messages", n)
+	}
+	if n := atomic.LoadInt32(&fastReceived); n >= overflowMessages {
+		t.Errorf("other participants should wait for the slow participant. got %d messages", n)
+	}
+	// nothing is lost once it catches up
+	if err := readMessages(t, slow, 10*time.Second, &slowReceived, nil); err != nil {
+		t.Errorf("slow participant should get every message. got %d, err: %v", slowReceived, err)
+	}
+	if err := <-sendDone; err != nil {
+		t.Errorf("failed to send messages. %s", err)
+	}
+	if err := <-fastDone; err != nil || fastReceived != overflowMessages {
+		t.Errorf("participant reading should get every message. got %d, err: %v", fastReceived, err)
+	}
+}
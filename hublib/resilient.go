@@ -0,0 +1,351 @@
+package hublib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RoomState is the connection state of a ResilientRoom.
+type RoomState int
+
+const (
+	// RoomConnected means messages go through the room.
+	RoomConnected RoomState = iota
+	// RoomReconnecting means the websocket dropped and the room is being joined again.
+	RoomReconnecting
+	// RoomClosed means the room was closed or reconnection was abandoned.
+	RoomClosed
+)
+
+func (state RoomState) String() string {
+	switch state {
+	case RoomConnected:
+		return "connected"
+	case RoomReconnecting:
+		return "reconnecting"
+	}
+	return "closed"
+}
+
+// ErrRoomClosed is returned when using a closed ResilientRoom.
+var ErrRoomClosed = errors.New("room closed")
+
+// ReconnectOptions tells how a ResilientRoom recovers from disconnections.
+type ReconnectOptions struct {
+	// MinBackoff is the delay before the first reconnection attempt. Default 500ms.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, doubled after each failure. Default 30s.
+	MaxBackoff time.Duration
+	// MaxAttempts gives up after that many failed attempts in a row. 0 retries forever.
+	MaxAttempts int
+	// PingInterval sends websocket pings to keep idle connections open and
+	// detect dead ones: the room is joined again when no pong came for twice
+	// that long. No ping when 0.
+	PingInterval time.Duration
+	// Setup is called after each successful join, before the room is used.
+	// Use it to enable encryption or to announce the participant again.
+	Setup func(room *Room) error
+	// OnStateChange is called whenever the room state changes.
+	OnStateChange func(state RoomState, err error)
+}
+
+// ResilientRoom is a room handle that joins the room again, with jittered
+// exponential backoff, whenever its websocket drops.
+type ResilientRoom struct {
+	client         *Client
+	room, password string
+	opts           ReconnectOptions
+
+	reconnectLock sync.Mutex // held while joining the room again
+	lock          sync.Mutex // protects current and state
+	current       *Room
+	state         RoomState
+	closed        chan struct{}
+}
+
+// JoinResilient joins room and keeps it joined. It retries the first join
+// too, unless the hub refuses to let the participant in.
+func (client *Client) JoinResilient(room, password string, opts ReconnectOptions) (*ResilientRoom, error) {
+	rr := client.newResilientRoom(room, password, opts)
+	current, err := rr.dial(context.Background())
+	if err != nil {
+		rr.setState(RoomClosed, err)
+		return nil, err
+	}
+	rr.start(current)
+	return rr, nil
+}
+
+// NewResilientRoom keeps a room already joined with client joined. Setup is
+// only called when joining it again. End-to-end encryption of a tunnel room
+// carries over to the new websockets.
+func (client *Client) NewResilientRoom(room *Room, opts ReconnectOptions) *ResilientRoom {
+	rr := client.newResilientRoom(room.room, room.password, opts)
+	rr.start(room)
+	return rr
+}
+
+func (client *Client) newResilientRoom(room, password string, opts ReconnectOptions) *ResilientRoom {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	return &ResilientRoom{
+		client:   client,
+		room:     room,
+		password: password,
+		opts:     opts,
+		state:    RoomReconnecting,
+		closed:   make(chan struct{}),
+	}
+}
+
+// start makes current the joined room and starts pinging the hub.
+func (rr *ResilientRoom) start(current *Room) {
+	rr.keepAlive(current)
+	rr.lock.Lock()
+	rr.current = current
+	rr.lock.Unlock()
+	rr.setState(RoomConnected, nil)
+	if rr.opts.PingInterval > 0 {
+		go rr.pingLoop()
+	}
+}
+
+// keepAlive makes room fail when the hub stops answering pings.
+func (rr *ResilientRoom) keepAlive(room *Room) {
+	if rr.opts.PingInterval > 0 {
+		room.keepAlive(2 * rr.opts.PingInterval)
+	}
+}
+
+// State returns the current connection state.
+func (rr *ResilientRoom) State() RoomState {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	return rr.state
+}
+
+// Room returns the room currently joined.
+func (rr *ResilientRoom) Room() *Room {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	return rr.current
+}
+
+// ReadJSON reads the next JSON message, joining the room again when its
+// websocket drops. Messages sent while disconnected are lost.
+func (rr *ResilientRoom) ReadJSON(v interface{}) error {
+	return rr.ReadJSONContext(context.Background(), v)
+}
+
+// ReadJSONContext is like ReadJSON but gives up when ctx is done. The room is
+// joined again on next use after an interrupted read.
+func (rr *ResilientRoom) ReadJSONContext(ctx context.Context, v interface{}) error {
+	for {
+		room, err := rr.usableRoom(ctx)
+		if err != nil {
+			return err
+		}
+		err = room.ReadJSONContext(ctx, v)
+		if err == nil || !room.isBroken() || ctx.Err() != nil {
+			return err
+		}
+		if err = rr.reconnect(ctx, room); err != nil {
+			return err
+		}
+	}
+}
+
+// WriteJSON writes a JSON message, joining the room again and retrying once
+// when its websocket drops.
+func (rr *ResilientRoom) WriteJSON(v interface{}) error {
+	return rr.WriteJSONContext(context.Background(), v)
+}
+
+// WriteJSONContext is like WriteJSON but gives up when ctx is done.
+func (rr *ResilientRoom) WriteJSONContext(ctx context.Context, v interface{}) error {
+	room, err := rr.usableRoom(ctx)
+	if err != nil {
+		return err
+	}
+	err = room.WriteJSONContext(ctx, v)
+	if err == nil || !room.isBroken() || ctx.Err() != nil {
+		return err
+	}
+	if err = rr.reconnect(ctx, room); err != nil {
+		return err
+	}
+	return rr.Room().WriteJSONContext(ctx, v)
+}
+
+// usableRoom returns the current room, joined again first if a previous
+// operation broke it.
+func (rr *ResilientRoom) usableRoom(ctx context.Context) (*Room, error) {
+	room := rr.Room()
+	if !room.isBroken() {
+		return room, nil
+	}
+	if err := rr.reconnect(ctx, room); err != nil {
+		return nil, err
+	}
+	return rr.Room(), nil
+}
+
+// Close closes the room and stops reconnecting.
+func (rr *ResilientRoom) Close() error {
+	rr.lock.Lock()
+	if rr.isClosed() {
+		rr.lock.Unlock()
+		return ErrRoomClosed
+	}
+	close(rr.closed)
+	current := rr.current
+	rr.lock.Unlock()
+	rr.setState(RoomClosed, nil)
+	return current.Close()
+}
+
+func (rr *ResilientRoom) setState(state RoomState, err error) {
+	rr.lock.Lock()
+	changed := rr.state != state
+	rr.state = state
+	rr.lock.Unlock()
+	if changed {
+		log.Println("hubclt| room", rr.room, "is", state, errString(err))
+		if rr.opts.OnStateChange != nil {
+			rr.opts.OnStateChange(state, err)
+		}
+	}
+}
+
+// reconnect replaces broken by a new room unless another goroutine already
+// did. The room stays reconnecting when ctx is done first.
+func (rr *ResilientRoom) reconnect(ctx context.Context, broken *Room) error {
+	rr.reconnectLock.Lock()
+	defer rr.reconnectLock.Unlock()
+	if rr.isClosed() {
+		return ErrRoomClosed
+	}
+	if rr.Room() != broken {
+		return nil
+	}
+	broken.Close()
+	rr.setState(RoomReconnecting, nil)
+	current, err := rr.dial(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			rr.setState(RoomClosed, err)
+		}
+		return err
+	}
+	// a tunnel keeps its sequence numbers so the peer accepts the messages
+	// and nonces are not reused with the same keys. A group keeps the nonces
+	// it saw so messages received before the drop cannot be replayed.
+	broken.writeLock.Lock()
+	secure := broken.secure
+	broken.writeLock.Unlock()
+	current.writeLock.Lock()
+	if secure != nil && !secure.group {
+		current.secure = secure
+	} else if secure != nil && current.secure != nil && current.secure.group {
+		current.secure.replays = secure.replays
+	}
+	current.writeLock.Unlock()
+	rr.keepAlive(current)
+	rr.lock.Lock()
+	if rr.isClosed() {
+		rr.lock.Unlock()
+		current.Close()
+		return ErrRoomClosed
+	}
+	rr.current = current
+	rr.lock.Unlock()
+	rr.setState(RoomConnected, nil)
+	return nil
+}
+
+func (rr *ResilientRoom) isClosed() bool {
+	select {
+	case <-rr.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// dial joins the room, retrying with jittered exponential backoff until
+// the hub refuses the credentials or ctx is done.
+func (rr *ResilientRoom) dial(ctx context.Context) (*Room, error) {
+	backoff := rr.opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		room, err := rr.client.JoinContext(ctx, rr.room, rr.password)
+		if err == nil && rr.opts.Setup != nil {
+			err = rr.opts.Setup(room)
+			if err != nil {
+				room.Close()
+			}
+		}
+		if err == nil {
+			return room, nil
+		}
+		if errors.Is(err, ErrAuth) || ctx.Err() != nil {
+			return nil, err
+		}
+		if rr.opts.MaxAttempts > 0 && attempt >= rr.opts.MaxAttempts {
+			return nil, err
+		}
+		// full jitter between half and all of the backoff
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("hubclt| failed to join room %s (attempt #%d). Retrying in %s. Err: %s\n", rr.room, attempt, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-rr.closed:
+			return nil, ErrRoomClosed
+		case <-ctx.Done():
+			return nil, opError(ctx, "join", rr.room, ctx.Err(), nil)
+		}
+		backoff *= 2
+		if backoff > rr.opts.MaxBackoff {
+			backoff = rr.opts.MaxBackoff
+		}
+	}
+}
+
+// pingLoop pings the hub so dead connections fail and are replaced.
+func (rr *ResilientRoom) pingLoop() {
+	ticker := time.NewTicker(rr.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			room := rr.Room()
+			err := room.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(rr.opts.PingInterval))
+			if err != nil && !room.isBroken() {
+				log.Printf("hubclt| failed to ping hub for room %s. Err: %s\n", rr.room, err)
+				// readers fail and reconnect once the websocket is closed
+				room.Close()
+			}
+		case <-rr.closed:
+			return
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,334 @@
+package hublib
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ResumeOptions tells how RelayResumable recovers from websocket drops.
+type ResumeOptions struct {
+	// Timeout closes the relay when nothing was heard from the peer for that
+	// long. Default 2 minutes.
+	Timeout time.Duration
+	// BufferSize is how much data is kept until the peer acknowledges it.
+	// Reading from the connection pauses when it is full. Default 4MB.
+	BufferSize int
+}
+
+// Resumable relays exchange frames made of a type byte, a stream offset, the
+// number of bytes received so far and a payload, all sent as binary messages.
+const (
+	resumeData    byte = iota + 1 // payload starts at offset of the stream
+	resumeAck                     // acknowledges data, also sent as heartbeat
+	resumeHello                   // sent after each join. Peer resends data not acknowledged and answers resumeWelcome
+	resumeWelcome                 // peer must resend data not acknowledged
+	resumeClose                   // stream ends at offset
+)
+
+const (
+	resumeHeaderSize = 17
+	// resumeAckEvery is how many bytes are received before acknowledging them.
+	resumeAckEvery = 64 * 1024
+)
+
+// resumableRelay is the state of one RelayResumable call.
+type resumableRelay struct {
+	rr      *ResilientRoom
+	netConn net.Conn
+	opts    ResumeOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	frameLock sync.Mutex // serializes frames so data goes out in order
+
+	lock      sync.Mutex // protects the fields below
+	space     *sync.Cond // signaled when acknowledgements free buffer space
+	sent      uint64     // bytes read from netConn
+	acked     uint64     // bytes the peer acknowledged
+	buffer    []byte     // bytes from acked to sent, resent when the peer asks
+	received  uint64     // bytes written to netConn
+	localDone bool       // netConn reached its end
+	lastHeard time.Time
+
+	// signals for controlLoop, never blocking the reader
+	hello   chan struct{}
+	ackNow  chan struct{}
+	resend  chan struct{}
+	welcome chan struct{} // like resend, answering resumeWelcome
+
+	finishOnce sync.Once
+	err        error
+}
+
+// RelayResumable copies data between the room and netConn like Relay, but
+// survives websocket drops. Data carries stream offsets and is kept until
+// the peer acknowledges it. After joining the room again, each side resends
+// what the other did not receive so netConn never notices the drop. The
+// peer must use RelayResumable too. The room is closed when the relay ends.
+func (rr *ResilientRoom) RelayResumable(netConn net.Conn, opts ResumeOptions) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Minute
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 4 * 1024 * 1024
+	}
+	relay := &resumableRelay{
+		rr:        rr,
+		netConn:   netConn,
+		opts:      opts,
+		lastHeard: time.Now(),
+		hello:     make(chan struct{}, 1),
+		ackNow:    make(chan struct{}, 1),
+		resend:    make(chan struct{}, 1),
+		welcome:   make(chan struct{}, 1),
+	}
+	relay.space = sync.NewCond(&relay.lock)
+	relay.ctx, relay.cancel = context.WithCancel(context.Background())
+	go relay.readLoop()
+	go relay.controlLoop()
+
+	buf := make([]byte, maxFramePayload-resumeHeaderSize)
+	for {
+		relay.lock.Lock()
+		for len(relay.buffer) >= relay.opts.BufferSize && relay.ctx.Err() == nil {
+			relay.space.Wait()
+		}
+		relay.lock.Unlock()
+		if relay.ctx.Err() != nil {
+			return relay.err
+		}
+		n, err := netConn.Read(buf)
+		if n > 0 {
+			relay.frameLock.Lock()
+			relay.lock.Lock()
+			offset := relay.sent
+			relay.buffer = append(relay.buffer, buf[:n]...)
+			relay.sent += uint64(n)
+			relay.lock.Unlock()
+			relay.writeFrame(resumeData, offset, buf[:n])
+			relay.frameLock.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if relay.ctx.Err() == nil {
+		log.Printf("hubclt| tcp connection ended. Closing resumable tunnel (room: %s)\n", rr.room)
+		relay.frameLock.Lock()
+		relay.lock.Lock()
+		relay.localDone = true
+		end := relay.sent
+		relay.lock.Unlock()
+		relay.writeFrame(resumeClose, end, nil)
+		relay.frameLock.Unlock()
+	}
+	// the peer answers with its own end of stream
+	<-relay.ctx.Done()
+	return relay.err
+}
+
+func (relay *resumableRelay) readLoop() {
+	var current *Room
+	for {
+		room, err := relay.rr.usableRoom(relay.ctx)
+		if err != nil {
+			relay.finish(err)
+			return
+		}
+		if room != current {
+			current = room
+			signal(relay.hello)
+		}
+		_, p, err := room.readMessage()
+		if err != nil {
+			if relay.ctx.Err() != nil {
+				return
+			}
+			if room.isBroken() {
+				log.Printf("hubclt| lost resumable tunnel room %s. Joining it again. Err: %s\n", relay.rr.room, err)
+				if err = relay.rr.reconnect(relay.ctx, room); err != nil {
+					relay.finish(err)
+					return
+				}
+			}
+			continue
+		}
+		if len(p) < resumeHeaderSize {
+			continue
+		}
+		relay.handle(p[0], binary.BigEndian.Uint64(p[1:]), binary.BigEndian.Uint64(p[9:]), p[resumeHeaderSize:])
+	}
+}
+
+func (relay *resumableRelay) handle(frameType byte, offset, ack uint64, payload []byte) {
+	relay.lock.Lock()
+	relay.lastHeard = time.Now()
+	if ack > relay.acked && ack <= relay.sent {
+		relay.buffer = relay.buffer[ack-relay.acked:]
+		relay.acked = ack
+		relay.space.Broadcast()
+	}
+	received := relay.received
+	relay.lock.Unlock()
+
+	switch frameType {
+	case resumeData:
+		end := offset + uint64(len(payload))
+		// skip data already received, and data following data lost while
+		// the peer was away until it is resent
+		if offset > received || end <= received {
+			return
+		}
+		if _, err := relay.netConn.Write(payload[received-offset:]); err != nil {
+			relay.netConn.Close()
+			return
+		}
+		relay.lock.Lock()
+		relay.received = end
+		relay.lock.Unlock()
+		if end/resumeAckEvery != received/resumeAckEvery {
+			signal(relay.ackNow)
+		}
+	case resumeHello:
+		signal(relay.welcome)
+	case resumeWelcome:
+		signal(relay.resend)
+	case resumeClose:
+		if offset != received {
+			return
+		}
+		log.Printf("hubclt| peer closed resumable tunnel (room: %s)\n", relay.rr.room)
+		relay.frameLock.Lock()
+		relay.lock.Lock()
+		localDone, end := relay.localDone, relay.sent
+		relay.lock.Unlock()
+		if !localDone {
+			relay.writeFrame(resumeClose, end, nil)
+		}
+		relay.frameLock.Unlock()
+		relay.finish(nil)
+	}
+}
+
+// controlLoop sends acknowledgements and heartbeats, says hello after each
+// join and resends data when the peer asks.
+func (relay *resumableRelay) controlLoop() {
+	heartbeat := relay.opts.Timeout / 4
+	if heartbeat > 5*time.Second {
+		heartbeat = 5 * time.Second
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-relay.ctx.Done():
+			return
+		case <-ticker.C:
+			relay.lock.Lock()
+			silence := time.Since(relay.lastHeard)
+			relay.lock.Unlock()
+			if silence > relay.opts.Timeout {
+				relay.finish(fmt.Errorf("no news from peer of room %s for %s. %w", relay.rr.room, silence.Round(time.Second), ErrTimeout))
+				return
+			}
+			relay.sendFrame(resumeAck)
+		case <-relay.ackNow:
+			relay.sendFrame(resumeAck)
+		case <-relay.hello:
+			relay.sendFrame(resumeHello)
+		case <-relay.resend:
+			relay.resendBuffer(false)
+		case <-relay.welcome:
+			relay.resendBuffer(true)
+		}
+	}
+}
+
+// resendBuffer sends again the data the peer did not acknowledge, and the end of stream.
+func (relay *resumableRelay) resendBuffer(welcome bool) {
+	relay.frameLock.Lock()
+	defer relay.frameLock.Unlock()
+	relay.lock.Lock()
+	offset, end, localDone := relay.acked, relay.sent, relay.localDone
+	data := append([]byte(nil), relay.buffer...)
+	relay.lock.Unlock()
+	if len(data) > 0 {
+		log.Printf("hubclt| resending %d bytes to resumable tunnel room %s\n", len(data), relay.rr.room)
+	}
+	chunk := maxFramePayload - resumeHeaderSize
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunk {
+			n = chunk
+		}
+		relay.writeFrame(resumeData, offset, data[:n])
+		offset += uint64(n)
+		data = data[n:]
+	}
+	if localDone {
+		relay.writeFrame(resumeClose, end, nil)
+	}
+	if welcome {
+		relay.writeFrame(resumeWelcome, 0, nil)
+	}
+}
+
+func (relay *resumableRelay) sendFrame(frameType byte) {
+	relay.frameLock.Lock()
+	relay.writeFrame(frameType, 0, nil)
+	relay.frameLock.Unlock()
+}
+
+// writeFrame sends a frame acknowledging the data received so far. Caller
+// must hold frameLock. Failures are ignored: the frame is resent, if needed,
+// once the room is joined again.
+func (relay *resumableRelay) writeFrame(frameType byte, offset uint64, payload []byte) {
+	relay.lock.Lock()
+	ack := relay.received
+	relay.lock.Unlock()
+	frame := make([]byte, resumeHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:], offset)
+	binary.BigEndian.PutUint64(frame[9:], ack)
+	copy(frame[resumeHeaderSize:], payload)
+	room, err := relay.rr.usableRoom(relay.ctx)
+	if err != nil {
+		return
+	}
+	err = room.writeMessage(websocket.BinaryMessage, frame)
+	if err != nil && room.isBroken() {
+		// the reader fails too and joins the room again
+		room.Close()
+	}
+}
+
+// signal wakes up controlLoop unless it already has to handle c.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// finish ends the relay, closing netConn and the room.
+func (relay *resumableRelay) finish(err error) {
+	relay.finishOnce.Do(func() {
+		if err != nil && err != ErrRoomClosed {
+			log.Printf("hubclt| closing resumable tunnel (room: %s). Err: %s\n", relay.rr.room, err)
+			relay.err = err
+		}
+		relay.cancel()
+		relay.lock.Lock()
+		relay.space.Broadcast()
+		relay.lock.Unlock()
+		relay.netConn.Close()
+		relay.rr.Close()
+	})
+}
@@ -0,0 +1,217 @@
+package hublib
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// End-to-end encryption hides room messages from the hub. Rooms shared by
+// many participants, like control rooms, are encrypted with a key derived
+// from a pre-shared key and the room name. Tunnel rooms between one client
+// and one agent use keys derived from an X25519 exchange mixed with the
+// pre-shared key, so only peers knowing it can talk and recorded traffic
+// stays unreadable even if the pre-shared key leaks later.
+
+// MaxClockSkew is how old or how far in the future an encrypted group
+// message may be before it is rejected as a replay. Newer messages are
+// rejected when their nonce was already seen.
+const MaxClockSkew = 5 * time.Minute
+
+// ErrDecrypt is returned when a room message fails authentication.
+var ErrDecrypt = errors.New("failed to decrypt room message")
+
+// KeyPair is an ephemeral X25519 key pair used to encrypt one tunnel room.
+type KeyPair struct {
+	private, public []byte
+}
+
+// NewKeyPair generates an ephemeral key pair.
+func NewKeyPair() (*KeyPair, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{private, public}, nil
+}
+
+// Public returns the public key encoded to be sent to the peer.
+func (kp *KeyPair) Public() string {
+	return base64.StdEncoding.EncodeToString(kp.public)
+}
+
+// secureChannel seals and opens the messages of a room.
+type secureChannel struct {
+	room     string
+	group    bool
+	send     cipher.AEAD
+	recv     cipher.AEAD
+	sendSeq  uint64
+	lastRecv uint64
+	replays  *replayCache // group messages only
+}
+
+// replayCache remembers the nonces of the group messages received until
+// they are too old to pass the MaxClockSkew check, so that a message
+// recorded by the hub cannot be accepted twice.
+type replayCache struct {
+	lock      sync.Mutex // protects the fields below
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time), lastPrune: time.Now()}
+}
+
+// firstSeen records the nonce of a message sent at sent and tells whether
+// it was not seen before.
+func (cache *replayCache) firstSeen(nonce []byte, sent time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	if now.Sub(cache.lastPrune) > time.Minute {
+		for n, t := range cache.seen {
+			if now.Sub(t) > MaxClockSkew {
+				delete(cache.seen, n)
+			}
+		}
+		cache.lastPrune = now
+	}
+	if _, found := cache.seen[string(nonce)]; found {
+		return false
+	}
+	cache.seen[string(nonce)] = sent
+	return true
+}
+
+// EncryptGroup encrypts every following message of the room with a key
+// derived from psk and the room name. Every participant must do the same.
+func (roomInfo *Room) EncryptGroup(psk []byte) error {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, psk, nil, []byte("hub room "+roomInfo.room)), key)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	roomInfo.writeLock.Lock()
+	roomInfo.secure = &secureChannel{room: roomInfo.room, group: true, send: aead, recv: aead, replays: newReplayCache()}
+	roomInfo.writeLock.Unlock()
+	return nil
+}
+
+// EncryptTunnel encrypts every following message of a room joined by two peers.
+// kp is this peer ephemeral key pair and peerPublic the other peer public key.
+// The peer that requested the tunnel is the initiator.
+func (roomInfo *Room) EncryptTunnel(psk []byte, kp *KeyPair, peerPublic string, initiator bool) error {
+	peer, err := base64.StdEncoding.DecodeString(peerPublic)
+	if err != nil || len(peer) != curve25519.PointSize {
+		return fmt.Errorf("invalid peer public key")
+	}
+	shared, err := curve25519.X25519(kp.private, peer)
+	if err != nil {
+		return err
+	}
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, psk, []byte("hub tunnel "+roomInfo.room)), keys)
+	if err != nil {
+		return err
+	}
+	toResponder, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	toInitiator, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return err
+	}
+	channel := &secureChannel{room: roomInfo.room, send: toResponder, recv: toInitiator}
+	if !initiator {
+		channel.send, channel.recv = toInitiator, toResponder
+	}
+	roomInfo.writeLock.Lock()
+	roomInfo.secure = channel
+	roomInfo.writeLock.Unlock()
+	return nil
+}
+
+// seal encrypts a message of type mt. Caller must hold Room.writeLock.
+//
+// Group messages are a random nonce followed by the sealed message type,
+// timestamp and payload. Tunnel messages are a sequence number followed by
+// the sealed message type and payload.
+func (channel *secureChannel) seal(mt int, p []byte) []byte {
+	if channel.group {
+		plain := make([]byte, 9+len(p))
+		plain[0] = byte(mt)
+		binary.BigEndian.PutUint64(plain[1:], uint64(time.Now().UnixNano()))
+		copy(plain[9:], p)
+		nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(plain)+channel.send.Overhead())
+		io.ReadFull(rand.Reader, nonce)
+		return channel.send.Seal(nonce, nonce, plain, []byte(channel.room))
+	}
+	channel.sendSeq++
+	plain := make([]byte, 1+len(p))
+	plain[0] = byte(mt)
+	copy(plain[1:], p)
+	out := make([]byte, 8, 8+len(plain)+channel.send.Overhead())
+	binary.BigEndian.PutUint64(out, channel.sendSeq)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[4:], out)
+	return channel.send.Seal(out, nonce, plain, []byte(channel.room))
+}
+
+// open authenticates and decrypts a message. Only one goroutine reads a room
+// at a time so no lock is needed.
+func (channel *secureChannel) open(msg []byte) (int, []byte, error) {
+	if channel.group {
+		if len(msg) < chacha20poly1305.NonceSizeX {
+			return 0, nil, ErrDecrypt
+		}
+		plain, err := channel.recv.Open(nil, msg[:chacha20poly1305.NonceSizeX], msg[chacha20poly1305.NonceSizeX:], []byte(channel.room))
+		if err != nil || len(plain) < 9 {
+			return 0, nil, ErrDecrypt
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(plain[1:])))
+		if d := time.Since(sent); d > MaxClockSkew || d < -MaxClockSkew {
+			return 0, nil, fmt.Errorf("rejecting room message sent at %s", sent)
+		}
+		if !channel.replays.firstSeen(msg[:chacha20poly1305.NonceSizeX], sent) {
+			return 0, nil, fmt.Errorf("rejecting replayed room message sent at %s", sent)
+		}
+		return int(plain[0]), plain[9:], nil
+	}
+	if len(msg) < 8 {
+		return 0, nil, ErrDecrypt
+	}
+	seq := binary.BigEndian.Uint64(msg)
+	if seq <= channel.lastRecv {
+		return 0, nil, fmt.Errorf("rejecting replayed room message #%d", seq)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[4:], msg[:8])
+	plain, err := channel.recv.Open(nil, nonce, msg[8:], []byte(channel.room))
+	if err != nil || len(plain) < 1 {
+		return 0, nil, ErrDecrypt
+	}
+	channel.lastRecv = seq
+	return int(plain[0]), plain[1:], nil
+}
@@ -1,10 +1,14 @@
 package hublib
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -12,120 +16,250 @@ import (
 type roomInfo struct {
 	name         string
 	password     string
-	participants []*websocket.Conn
+	created      time.Time
+	lock         sync.Mutex // protects participants
+	participants []*participant
 }
 
-var (
-	upgrader = websocket.Upgrader{}
-	rooms    = make(map[string]*roomInfo)
-	lock     = sync.Mutex{}
-)
+// HubOptions configures a Hub.
+type HubOptions struct {
+	// Token must be provided in the x-token header by agents and clients.
+	Token string
+	// AdminToken must be provided in the x-token header to query the admin API.
+	// Admin API is disabled when empty.
+	AdminToken string
+	// Upgrader is used to upgrade http requests to websocket connections.
+	// Zero value is fine.
+	Upgrader websocket.Upgrader
+	// QueueSize is the number of messages queued for each participant.
+	// DefaultQueueSize is used when 0.
+	QueueSize int
+	// Overflow tells what to do when a participant queue is full.
+	Overflow OverflowPolicy
+	// WriteTimeout closes participants that take longer to accept a message.
+	// No timeout when 0.
+	WriteTimeout time.Duration
+	// RequireClientCert rejects connections that did not present a verified
+	// TLS client certificate, on top of the token. See ServerTLSConfig.
+	RequireClientCert bool
+}
+
+// Hub relays messages between the participants of its rooms.
+// Each Hub owns its rooms so many hubs can run in the same process.
+type Hub struct {
+	opts     HubOptions
+	rooms    map[string]*roomInfo
+	conns    map[*websocket.Conn]struct{}
+	lock     sync.Mutex // protects rooms, conns and closed. Taken before roomInfo.lock
+	closed   bool
+	handlers sync.WaitGroup
+}
 
+// NewHub creates a hub ready to be served with ServeHTTP.
+func NewHub(opts HubOptions) *Hub {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	return &Hub{
+		opts:  opts,
+		rooms: make(map[string]*roomInfo),
+		conns: make(map[*websocket.Conn]struct{}),
+	}
+}
+
+// NewHubHandlerFunc creates a new Hub and returns its http handler.
 func NewHubHandlerFunc(token string) func(w http.ResponseWriter, r *http.Request) {
-	hubService := func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("x-token") != token {
-			w.WriteHeader(401)
-			log.Println("hub   | invalid token provided")
-			return
-		}
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			w.WriteHeader(400)
-			log.Println("hub   | upgrade failed:", err)
-			return
-		}
-		defer c.Close()
-		var req hubRequest
-		err = c.ReadJSON(&req)
+	return NewHub(HubOptions{Token: token}).ServeHTTP
+}
+
+// ServeHTTP upgrades the request to a websocket and lets the peer join a room.
+func (hub *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-token") != hub.opts.Token {
+		w.WriteHeader(401)
+		log.Println("hub   | invalid token provided")
+		return
+	}
+	if !hub.verifiedClient(r) {
+		w.WriteHeader(401)
+		log.Println("hub   | no valid client certificate provided by", r.RemoteAddr)
+		return
+	}
+	if !hub.track() {
+		w.WriteHeader(503)
+		log.Println("hub   | hub is shutting down")
+		return
+	}
+	defer hub.handlers.Done()
+	c, err := hub.opts.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("hub   | upgrade failed:", err)
+		return
+	}
+	if !hub.addConn(c) {
+		c.Close()
+		return
+	}
+	defer hub.removeConn(c)
+	defer c.Close()
+	var req hubRequest
+	err = c.ReadJSON(&req)
+	if err != nil {
+		log.Println("hub   | failed to parse request:", err)
+		c.WriteJSON(hubResponse{"error", false, "failed to parse request"})
+		return
+	}
+	if req.Type == "join" {
+		err = hub.handleJoin(req.Room, req.Password, c)
 		if err != nil {
-			log.Println("hub   | failed to parse request:", err)
-			c.WriteJSON(hubResponse{"error", false, "failed to parse request"})
-			return
-		}
-		if req.Type == "join" {
-			err = handleJoin(req.Room, req.Password, c)
-			if err != nil {
-				log.Println("hub   | failed to enter room", err)
-				return
-			}
-		} else {
-			log.Println("hub   | unknown request type", req.Type)
-			c.WriteJSON(hubResponse{"error", false, "unknown request type"})
+			log.Println("hub   | failed to enter room", err)
 			return
 		}
+	} else {
+		log.Println("hub   | unknown request type", req.Type)
+		c.WriteJSON(hubResponse{"error", false, "unknown request type"})
+		return
+	}
+}
+
+// verifiedClient tells whether r comes from a client with a verified
+// certificate, when the hub requires one.
+func (hub *Hub) verifiedClient(r *http.Request) bool {
+	return !hub.opts.RequireClientCert || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0)
+}
+
+// Shutdown closes every websocket connection and waits for their handlers
+// to return or for ctx to be done. The hub rejects new connections afterward.
+func (hub *Hub) Shutdown(ctx context.Context) error {
+	hub.lock.Lock()
+	hub.closed = true
+	for c := range hub.conns {
+		c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "hub shutting down"),
+			time.Now().Add(time.Second))
+		c.Close()
+	}
+	hub.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		hub.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+// track registers a running handler unless the hub is shut down.
+func (hub *Hub) track() bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.closed {
+		return false
 	}
-	return hubService
+	hub.handlers.Add(1)
+	return true
 }
 
-func handleJoin(roomName string, password string, c *websocket.Conn) error {
-	lock.Lock()
-	room, found := rooms[roomName]
+func (hub *Hub) addConn(c *websocket.Conn) bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.closed {
+		return false
+	}
+	hub.conns[c] = struct{}{}
+	return true
+}
+
+func (hub *Hub) removeConn(c *websocket.Conn) {
+	hub.lock.Lock()
+	delete(hub.conns, c)
+	hub.lock.Unlock()
+}
+
+func (hub *Hub) handleJoin(roomName string, password string, c *websocket.Conn) error {
+	hub.lock.Lock()
+	room, found := hub.rooms[roomName]
 	if !found {
 		// first to join open the room
 		log.Println("hub   |", c.RemoteAddr().String(), "create room", roomName)
-		room = &roomInfo{roomName, password, make([]*websocket.Conn, 0)}
-		rooms[roomName] = room
+		room = &roomInfo{name: roomName, password: password, created: time.Now(), participants: make([]*participant, 0)}
+		hub.rooms[roomName] = room
 	} else {
-		log.Println("hub   |", c.RemoteAddr().String(), "trying to enter room", roomName, len(room.participants), "participants")
+		room.lock.Lock()
+		count := len(room.participants)
+		room.lock.Unlock()
+		log.Println("hub   |", c.RemoteAddr().String(), "trying to enter room", roomName, count, "participants")
 	}
 
 	if password != room.password {
-		lock.Unlock()
+		hub.lock.Unlock()
 		log.Println("hub   |", c.RemoteAddr().String(), "invalid password provided")
 		c.WriteJSON(hubResponse{"error", false, "invalid password"})
 		return fmt.Errorf("invalid room password")
 	}
-	room.participants = append(room.participants, c)
-	lock.Unlock()
-	log.Println("hub   |", c.RemoteAddr().String(), "entered room", roomName, len(room.participants), "participants")
-	c.WriteJSON(hubResponse{"joined", true, ""})
+	self := newParticipant(c, hub.opts.QueueSize)
+	joined, _ := json.Marshal(hubResponse{"joined", true, ""})
+	// queued before entering the room so it is the first message the participant gets
+	self.out <- outMessage{websocket.TextMessage, joined}
+	room.lock.Lock()
+	room.participants = append(room.participants, self)
+	count := len(room.participants)
+	room.lock.Unlock()
+	hub.lock.Unlock()
+	log.Println("hub   |", c.RemoteAddr().String(), "entered room", roomName, count, "participants")
+	go self.writeLoop(hub.opts.WriteTimeout)
 
 	for {
 		mt, message, err := c.ReadMessage()
 		if err != nil {
 			log.Println("hub   |", c.RemoteAddr().String(), "read error", err, "Removing participant from room")
-			lock.Lock()
-			removeParticipant(room.participants, c)
-			if len(room.participants) == 0 {
-				log.Println("No more participant in room. Closing room", roomName)
-				delete(rooms, roomName)
-			}
-			lock.Unlock()
+			hub.leave(room, self)
 			break
 		}
 		log.Printf("hub   | recv %d bytes", len(message))
-		err = room.broadcast(c, mt, message)
+		atomic.AddInt64(&self.bytesRecv, int64(len(message)))
+		room.broadcast(self, outMessage{mt, message}, hub.opts.Overflow)
 	}
 	return nil
 }
 
-func (room *roomInfo) broadcast(source *websocket.Conn, mt int, msg []byte) error {
-	lock.Lock()
-	defer lock.Unlock()
-	toDelete := make([]*websocket.Conn, 0)
-
+// broadcast queues msg for every participant of the room but source.
+// Only the room lock is taken and only while copying the participants list.
+func (room *roomInfo) broadcast(source *participant, msg outMessage, policy OverflowPolicy) {
+	room.lock.Lock()
+	participants := make([]*participant, 0, len(room.participants))
 	for _, participant := range room.participants {
 		if participant != source {
-			log.Printf("hub   | sending %d bytes to participant %s in room %s\n", len(msg), participant.RemoteAddr().String(), room.name)
-			err := participant.WriteMessage(mt, msg)
-			if err != nil {
-				toDelete = append(toDelete, participant)
-			}
+			participants = append(participants, participant)
 		}
 	}
-	for _, disconnected := range toDelete {
-		room.participants = removeParticipant(room.participants, disconnected)
-		if len(room.participants) == 0 {
-			log.Println("No more participant in room. Closing room", room.name)
-			delete(rooms, room.name)
-		}
+	room.lock.Unlock()
+
+	for _, participant := range participants {
+		log.Printf("hub   | sending %d bytes to participant %s in room %s\n", len(msg.data), participant.conn.RemoteAddr().String(), room.name)
+		participant.enqueue(msg, policy)
 	}
+}
 
-	return nil
+// leave removes a participant from its room and closes the room when empty.
+func (hub *Hub) leave(room *roomInfo, p *participant) {
+	p.close()
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	room.participants = removeParticipant(room.participants, p)
+	if len(room.participants) == 0 && hub.rooms[room.name] == room {
+		log.Println("No more participant in room. Closing room", room.name)
+		delete(hub.rooms, room.name)
+	}
 }
 
-func removeParticipant(participants []*websocket.Conn, participantToRemove *websocket.Conn) []*websocket.Conn {
+func removeParticipant(participants []*participant, participantToRemove *participant) []*participant {
 	for i, participant := range participants {
 		if participantToRemove == participant {
 			return removeIndex(participants, i)
@@ -134,6 +268,6 @@ func removeParticipant(participants []*websocket.Conn, participantToRemove *webs
 	return participants
 }
 
-func removeIndex(slice []*websocket.Conn, s int) []*websocket.Conn {
+func removeIndex(slice []*participant, s int) []*participant {
 	return append(slice[:s], slice[s+1:]...)
 }
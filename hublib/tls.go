@@ -0,0 +1,181 @@
+package hublib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as lower
+// case hex, the format expected by ClientTLSConfig pins.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadCertPool reads the PEM encoded certificates of filename.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(dat) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// ClientTLSConfig builds the TLS configuration a Client uses to reach a
+// wss:// hub. Empty arguments keep the default behavior.
+//
+// The hub certificate is verified against the certificates of caFile instead
+// of the system roots. certFile and keyFile are presented to hubs requiring
+// client certificates. pins are SHA-256 fingerprints, hex encoded with or
+// without colons, and the hub must present a certificate matching one of
+// them. Pinned certificates need not be signed by a trusted CA unless caFile
+// is also given, so self-signed hub certificates can be used. Without caFile
+// the pin must match the hub certificate itself. With caFile it may match
+// any certificate of the verified chain, such as an intermediate CA.
+func ClientTLSConfig(caFile, certFile, keyFile string, pins []string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if len(caFile) > 0 {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(pins) == 0 {
+		return config, nil
+	}
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		pin = strings.ToLower(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", pin)
+		}
+		pinned[pin] = true
+	}
+	matches := func(raw []byte) bool {
+		sum := sha256.Sum256(raw)
+		return pinned[hex.EncodeToString(sum[:])]
+	}
+	// pins replace the verification of the chain unless a CA is given
+	skipChain := config.RootCAs == nil
+	config.InsecureSkipVerify = skipChain
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if skipChain {
+			// only the leaf proves the hub holds the key of the certificate,
+			// anyone can append a pinned certificate to the chain it sends
+			if len(rawCerts) > 0 && matches(rawCerts[0]) {
+				return nil
+			}
+			return fmt.Errorf("hub certificate does not match any pinned fingerprint")
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if matches(cert.Raw) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("hub certificate chain does not match any pinned fingerprint")
+	}
+	return config, nil
+}
+
+// ServerTLSConfig makes config verify the client certificates signed by the
+// CAs of clientCAFile. Certificates are verified when given so other pages
+// served along the hub stay reachable; set HubOptions.RequireClientCert so
+// the hub rejects connections without one.
+func ServerTLSConfig(config *tls.Config, clientCAFile string) error {
+	pool, err := LoadCertPool(clientCAFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// CertReloader serves a certificate loaded from PEM files and loads it again
+// when the files change on disk, so renewed certificates are picked up
+// without restarting the hub.
+type CertReloader struct {
+	certFile, keyFile string
+	lock              sync.Mutex // protects cert and modTime
+	cert              *tls.Certificate
+	modTime           time.Time
+}
+
+// NewCertReloader loads the certificate of certFile and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := reloader.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err = reloader.load(modTime); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate. The previous
+// certificate is kept when the files changed but cannot be loaded, as
+// happens while they are being written.
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	modTime, err := reloader.lastModified()
+	if err == nil && !modTime.Equal(reloader.modTime) {
+		err = reloader.load(modTime)
+		if err != nil {
+			log.Println("hub   | failed to reload certificate", reloader.certFile, err)
+		}
+	}
+	return reloader.cert, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (reloader *CertReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (reloader *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	if reloader.cert != nil {
+		log.Println("hub   | reloaded certificate", reloader.certFile)
+	}
+	reloader.cert, reloader.modTime = &cert, modTime
+	return nil
+}
@@ -0,0 +1,86 @@
+package hublib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AgentDialer opens connections to hosts reachable from the agent serving a
+// control room, one tunnel room per connection. It joins the control room on
+// its first dial and stays in it until Close. It must not be copied after
+// first use.
+type AgentDialer struct {
+	Client         *Client
+	Room, Password string
+	// Agent is the name of the agent that must open the tunnels. When empty,
+	// every agent of the room opens one and all but the first are closed.
+	Agent string
+	// E2EKey encrypts the rooms end-to-end like hub -e2e-key. The agent must
+	// use the same key. No encryption when nil.
+	E2EKey []byte
+
+	lock    sync.Mutex // protects control
+	control *tunnelControl
+}
+
+// DialContext connects to address through the agent. It has the signature
+// of net.Dialer.DialContext so it fits http.Transport and similar.
+func (dialer *AgentDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s cannot be tunneled through the agent", network)
+	}
+	control, err := dialer.controlRoom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return control.dial(ctx, address, dialer.Agent)
+}
+
+// controlRoom returns the control room shared by the dials, joining it
+// again once it closed.
+func (dialer *AgentDialer) controlRoom(ctx context.Context) (*tunnelControl, error) {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	if dialer.control != nil && dialer.control.room.State() != RoomClosed {
+		return dialer.control, nil
+	}
+	control, err := joinTunnelControl(ctx, dialer.Client, dialer.Room, dialer.Password, dialer.E2EKey)
+	if err != nil {
+		return nil, err
+	}
+	dialer.control = control
+	return control, nil
+}
+
+// Close leaves the control room. Connections already dialed stay open.
+func (dialer *AgentDialer) Close() error {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	if dialer.control == nil {
+		return nil
+	}
+	err := dialer.control.room.Close()
+	dialer.control = nil
+	return err
+}
+
+// NewAgentTransport returns an http.RoundTripper sending requests to hosts
+// behind the agent. Like any http.Transport, it keeps idle connections to
+// reuse them for later requests to the same host:port. Close the dialer once
+// the transport is no longer used.
+func NewAgentTransport(dialer *AgentDialer) *http.Transport {
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
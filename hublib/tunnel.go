@@ -0,0 +1,343 @@
+package hublib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tunnelRequest and tunnelResponse are the control room messages used to
+// open a tunnel room. They match the ones of hub -agent and hub -client so
+// a Listener can serve CLI clients and Dial can reach CLI agents.
+type tunnelRequest struct {
+	Type, Destination, Refid string
+	PublicKey                string `json:",omitempty"`
+	Agent                    string `json:",omitempty"` // name of the agent that must answer. Any agent when empty
+}
+
+type tunnelResponse struct {
+	Type, Room, Password, Refid, Cause string
+	Success                            bool
+	PublicKey                          string `json:",omitempty"`
+}
+
+// roomAddr is the address of a Listener: the name of its control room.
+type roomAddr string
+
+func (addr roomAddr) Network() string { return "hub" }
+func (addr roomAddr) String() string  { return string(addr) }
+
+// Listener accepts the tunnels requested in a control room, each one being
+// a RoomConn over its own tunnel room. It implements net.Listener. Only one
+// listener, or agent, may serve a control room.
+type Listener struct {
+	client    *Client
+	control   *ResilientRoom
+	conns     chan *RoomConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen joins the control room and accepts the tunnels requested there by
+// Dial or by hub -client.
+func Listen(client *Client, room, password string) (*Listener, error) {
+	control, err := client.JoinResilient(room, password, ReconnectOptions{PingInterval: 30 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	listener := &Listener{
+		client:  client,
+		control: control,
+		conns:   make(chan *RoomConn),
+		done:    make(chan struct{}),
+	}
+	go listener.serve()
+	return listener, nil
+}
+
+func (listener *Listener) serve() {
+	for {
+		var req tunnelRequest
+		err := listener.control.ReadJSON(&req)
+		if err != nil {
+			if listener.control.State() == RoomClosed {
+				listener.Close()
+				return
+			}
+			continue
+		}
+		if req.Type == "createTunnel" {
+			go listener.open(req.Refid)
+		}
+	}
+}
+
+// open creates and joins a tunnel room, then tells the requester to join it too.
+func (listener *Listener) open(refid string) {
+	name, password := uuid.New().String(), uuid.New().String()
+	room, err := listener.client.Join(name, password)
+	if err != nil {
+		log.Printf("hubclt| failed to create tunnel room requested by %s. Err: %s\n", refid, err)
+		listener.control.WriteJSON(tunnelResponse{
+			Type:  "tunnelCreationFailed",
+			Refid: refid,
+			Cause: "failed to create room for tunnel"})
+		return
+	}
+	err = listener.control.WriteJSON(tunnelResponse{
+		Type:     "tunnelCreated",
+		Room:     name,
+		Password: password,
+		Refid:    refid,
+		Success:  true})
+	if err != nil {
+		room.Close()
+		return
+	}
+	conn := NewRoomConn(room)
+	select {
+	case listener.conns <- conn:
+	case <-listener.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for the next tunnel.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, ErrRoomClosed
+	}
+}
+
+// Close stops accepting tunnels and leaves the control room. Accepted
+// connections stay open.
+func (listener *Listener) Close() error {
+	err := ErrRoomClosed
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+		err = listener.control.Close()
+	})
+	return err
+}
+
+// Addr returns the control room name.
+func (listener *Listener) Addr() net.Addr {
+	return roomAddr(listener.control.room)
+}
+
+// Dial asks the listener of the control room for a tunnel and returns it.
+func Dial(client *Client, room, password string) (*RoomConn, error) {
+	return DialContext(context.Background(), client, room, password)
+}
+
+// DialContext is like Dial but gives up when ctx is done before the tunnel is open.
+func DialContext(ctx context.Context, client *Client, room, password string) (*RoomConn, error) {
+	return dialTunnel(ctx, client, room, password, "", nil)
+}
+
+// dialTunnel asks the agent or listener of the control room for a tunnel to
+// destination. Rooms are encrypted end-to-end when psk is not nil.
+func dialTunnel(ctx context.Context, client *Client, room, password, destination string, psk []byte) (*RoomConn, error) {
+	control, err := client.JoinContext(ctx, room, password)
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+	req := tunnelRequest{Type: "createTunnel", Destination: destination, Refid: uuid.New().String()}
+	var kp *KeyPair
+	if psk != nil {
+		if err = control.EncryptGroup(psk); err != nil {
+			return nil, err
+		}
+		if kp, err = NewKeyPair(); err != nil {
+			return nil, err
+		}
+		req.PublicKey = kp.Public()
+	}
+	err = control.WriteJSONContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp tunnelResponse
+	for resp.Refid != req.Refid {
+		resp = tunnelResponse{}
+		err = control.ReadJSONContext(ctx, &resp)
+		if err != nil && !control.isBroken() {
+			// messages of participants without the key
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Type != "tunnelCreated" {
+		return nil, fmt.Errorf("tunnel creation to %s failed. cause: %s", destination, resp.Cause)
+	}
+	return joinTunnel(ctx, client, resp, kp, psk)
+}
+
+// joinTunnel joins the tunnel room of resp. It is encrypted with a key agreed
+// with the agent using kp when psk is not nil.
+func joinTunnel(ctx context.Context, client *Client, resp tunnelResponse, kp *KeyPair, psk []byte) (*RoomConn, error) {
+	tunnel, err := client.JoinContext(ctx, resp.Room, resp.Password)
+	if err != nil {
+		return nil, err
+	}
+	if psk != nil {
+		err = tunnel.EncryptTunnel(psk, kp, resp.PublicKey, true)
+		if err != nil {
+			tunnel.Close()
+			return nil, err
+		}
+	}
+	return NewRoomConn(tunnel), nil
+}
+
+// lateAnswerTimeout is how long a tunnelControl keeps closing the tunnels
+// answered to a request once its dial returned.
+const lateAnswerTimeout = time.Minute
+
+// tunnelControl shares one control room among many dials and routes each
+// answer to the dial waiting for its Refid.
+type tunnelControl struct {
+	client  *Client
+	room    *ResilientRoom
+	psk     []byte
+	lock    sync.Mutex // protects waiters
+	waiters map[string]*tunnelWaiter
+}
+
+// tunnelWaiter is a pending tunnel request. Its first answer goes to answer.
+// Agents open a tunnel for every other answer, nobody uses them.
+type tunnelWaiter struct {
+	kp       *KeyPair
+	answer   chan tunnelResponse
+	answered bool
+}
+
+// joinTunnelControl joins the control room, encrypted when psk is not nil,
+// and keeps it joined until it is closed.
+func joinTunnelControl(ctx context.Context, client *Client, room, password string, psk []byte) (*tunnelControl, error) {
+	setup := func(control *Room) error {
+		if psk != nil {
+			return control.EncryptGroup(psk)
+		}
+		return nil
+	}
+	current, err := client.JoinContext(ctx, room, password)
+	if err != nil {
+		return nil, err
+	}
+	if err = setup(current); err != nil {
+		current.Close()
+		return nil, err
+	}
+	control := &tunnelControl{
+		client:  client,
+		room:    client.NewResilientRoom(current, ReconnectOptions{PingInterval: 30 * time.Second, Setup: setup}),
+		psk:     psk,
+		waiters: make(map[string]*tunnelWaiter),
+	}
+	go control.readLoop()
+	return control, nil
+}
+
+func (control *tunnelControl) readLoop() {
+	for {
+		var resp tunnelResponse
+		err := control.room.ReadJSON(&resp)
+		if err != nil {
+			if control.room.State() == RoomClosed {
+				return
+			}
+			// messages of participants without the key
+			continue
+		}
+		control.lock.Lock()
+		waiter, found := control.waiters[resp.Refid]
+		deliver := found && !waiter.answered
+		if deliver {
+			waiter.answered = true
+			waiter.answer <- resp
+		}
+		control.lock.Unlock()
+		if found && !deliver {
+			go control.discard(resp, waiter.kp)
+		}
+	}
+}
+
+// dial asks agent, or any agent when empty, for a tunnel to destination.
+func (control *tunnelControl) dial(ctx context.Context, destination, agent string) (*RoomConn, error) {
+	req := tunnelRequest{Type: "createTunnel", Destination: destination, Refid: uuid.New().String(), Agent: agent}
+	waiter := &tunnelWaiter{answer: make(chan tunnelResponse, 1)}
+	if control.psk != nil {
+		var err error
+		if waiter.kp, err = NewKeyPair(); err != nil {
+			return nil, err
+		}
+		req.PublicKey = waiter.kp.Public()
+	}
+	control.lock.Lock()
+	control.waiters[req.Refid] = waiter
+	control.lock.Unlock()
+	defer control.forget(req.Refid)
+
+	err := control.room.WriteJSONContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-waiter.answer:
+		if resp.Type != "tunnelCreated" {
+			return nil, fmt.Errorf("tunnel creation to %s failed. cause: %s", destination, resp.Cause)
+		}
+		return joinTunnel(ctx, control.client, resp, waiter.kp, control.psk)
+	case <-ctx.Done():
+		return nil, opError(ctx, "dial", control.room.room, ctx.Err(), nil)
+	}
+}
+
+// forget is called once the dial of refid returned. Answers still coming
+// for it are discarded until lateAnswerTimeout expires.
+func (control *tunnelControl) forget(refid string) {
+	control.lock.Lock()
+	waiter := control.waiters[refid]
+	waiter.answered = true
+	control.lock.Unlock()
+	select {
+	case resp := <-waiter.answer:
+		// answered while the dial gave up
+		go control.discard(resp, waiter.kp)
+	default:
+	}
+	time.AfterFunc(lateAnswerTimeout, func() {
+		control.lock.Lock()
+		delete(control.waiters, refid)
+		control.lock.Unlock()
+	})
+}
+
+// discard closes the tunnel of an answer nobody waits for, so the agent
+// closes its destination connection too.
+func (control *tunnelControl) discard(resp tunnelResponse, kp *KeyPair) {
+	if resp.Type != "tunnelCreated" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := joinTunnel(ctx, control.client, resp, kp, control.psk)
+	if err != nil {
+		log.Printf("hubclt| failed to close unused tunnel room %s. Err: %s\n", resp.Room, err)
+		return
+	}
+	conn.Close()
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,17 +23,51 @@ var (
 	domain           = flag.String("domain", "", "https domain to whitelist in certificate")
 	token            = flag.String("token", "Please don't mention my secret phrase!", "token to provide when connecting to websocket server.\nSame token must be used by hub, agent and client.")
 	dev              = flag.Bool("dev", false, "to listen in plain http on port 8080 without Let's Encrypt certificate")
+	certFile         = flag.String("cert", "", "PEM certificate file served by the hub instead of requesting one from Let's Encrypt. Reloaded when changed. Used with -key")
+	keyFile          = flag.String("key", "", "PEM private key file of -cert")
+	httpListen       = flag.String("http-listen", "", "plain http host:port (ex.: :http) answering Let's Encrypt HTTP-01 challenges and redirecting other requests to https")
 	listen           = flag.String("listen", ":https", "listening host:port")
 	agent            = flag.String("agent", "", "start hub as an agent and connect to spefified hub. Ex.: wss://10.0.0.3/hub/")
 	password         = flag.String("password", "my room password", "specifies a password that the agent requires from clients")
+	agentName        = flag.String("agent-name", "", "name the agent announces in the room, host name by default.\nFor clients, the only agent to send requests to")
+	agentLabels      = flag.String("agent-labels", "", "comma separated key=value labels the agent announces in the room (ex.: site=paris,env=lab).\nFor clients, only agents having all these labels are used")
+	agentSelect      = flag.String("agent-select", "round-robin", "how clients pick among the agents of the room: round-robin or least-loaded")
+	policyFile       = flag.String("policy", "", "JSON file of allow and deny rules restricting the destinations the agent connects to. See above for an example.")
+	allowExec        = flag.String("allow-exec", "", "comma separated programs the agent runs for clients using -exec (ex.: uptime,systemctl).\nCommands are refused when empty")
+	execCommand      = flag.String("exec", "", "runs this command on the agent, prints its output and exits with its exit code. Must be used with -client argument")
+	allowShell       = flag.Bool("allow-shell", false, "lets clients using -shell open a login shell of the agent user on the agent host (linux agents only)")
+	shell            = flag.Bool("shell", false, "opens an interactive login shell on the agent host. Must be used with -client argument")
+	allowFiles       = flag.String("allow-files", "", "directory on the agent host where clients using -put and -get write and read files.\nFile transfers are refused when empty")
+	putFile          = flag.String("put", "", "sends this local file to the agent, at the path given as last argument. Must be used with -client argument")
+	getFile          = flag.String("get", "", "fetches this agent file into the local file given as last argument. Must be used with -client argument")
+	controlAPI       = flag.String("control", "", "serves the client control API on this loopback host:port, or on unix:/path/to/socket, to list, add and remove tcp tunnels at runtime. Must be used with -client argument")
+	controlToken     = flag.String("control-token", "", "token to provide in x-token header to use the client control API.\nRequired when -control is a host:port, optional for unix sockets which only the current user can reach")
 	client           = flag.String("client", "", "start hub as a client and connect to spefified hub. Ex.: wss://10.0.0.3/hub/")
 	room             = flag.String("room", "control room", "room used by client and agent to allow client to send command to agent")
 	tunnel           = flag.String("tunnel", "", "creates a tunnel from this computer (-listen) to agent. This parameter contains host:port to tunnel to. Must be used with -client and -listen arguments")
 	tunnelsFile      = flag.String("tunnels", "", "creates many tunnels as specified in JSON file. See above for an example.")
+	reverse          = flag.String("reverse", "", "creates a reverse tunnel: the agent listens on this host:port and relays connections to -tunnel host:port reachable from the client. Must be used with -client and -tunnel arguments")
+	socks5           = flag.String("socks5", "", "runs a SOCKS5 proxy on this host:port. Each CONNECT request creates a tunnel to the requested destination through the agent. Must be used with -client argument")
+	httpProxy        = flag.String("http-proxy", "", "runs an HTTP proxy on this host:port. CONNECT and absolute-URI requests are forwarded through tunnels to the agent. Must be used with -client argument")
+	udp              = flag.Bool("udp", false, "tunnels udp datagrams instead of tcp connections. Must be used with -client and -tunnel arguments")
+	udpTimeout       = flag.Duration("udp-timeout", time.Minute, "closes udp flows idle for this duration. Used by both client and agent")
+	resumeTimeout    = flag.Duration("resume-timeout", 2*time.Minute, "how long client and agent wait for each other to resume a tcp tunnel after a hub disconnection.\nTunnels close on disconnection when 0 on either side")
+	agentTimeout     = flag.Duration("agent-timeout", 30*time.Second, "time the client waits for the agent to answer a tunnel request before giving up")
 	rdp              = flag.String("rdp", "", "creates a tunnel from this computer to agent on RDP port. This parameter contains host to tunnel to. Must be used with -client argument. It will autonatically start mstsc.exe")
+	e2e              = flag.Bool("e2e", false, "encrypts messages between client and agent end-to-end using the room password as shared secret.\nThe hub sees the room password so prefer -e2e-key")
+	e2eSecret        = flag.String("e2e-key", "", "encrypts messages between client and agent end-to-end with this shared secret.\nSame key must be used by agent and client. The hub never sees it")
 	bypassProxy      = flag.Bool("bypass-proxy", false, "bypass system proxy")
-	proxy = flag.String("proxy", "", "specifies proxy URL")
+	proxy            = flag.String("proxy", "", "specifies proxy URL")
+	caFile           = flag.String("ca-file", "", "PEM file of the CA certificates used to verify the hub certificate instead of the system ones. Used by client and agent")
+	pins             = flag.String("pin", "", "comma separated SHA-256 fingerprints of the hub certificates to accept, even self-signed unless -ca-file is used. Used by client and agent")
+	clientCert       = flag.String("client-cert", "", "PEM certificate presented to a hub requiring client certificates. Used with -client-key by client and agent")
+	clientKey        = flag.String("client-key", "", "PEM private key of -client-cert")
+	clientCA         = flag.String("client-ca", "", "PEM file of the CA certificates the hub uses to verify client certificates.\nWhen set, agents and clients must present a certificate signed by one of them on top of the token")
+	multiplex        = flag.Bool("mux", false, "carry all client tunnel connections as streams over one websocket shared with the agent")
 	exitOnDisconnect = flag.Bool("exit-on-disconnect", false, "Stops the client when the tcp connection on the tunnel disconnects")
+	adminToken       = flag.String("admin-token", "", "token to provide in x-token header to query the hub admin API on /hub/rooms.\nAdmin API is disabled when empty.")
+	queueSize        = flag.Int("queue-size", hublib.DefaultQueueSize, "number of messages the hub queues for each room participant")
+	overflow         = flag.String("overflow", "block", "what the hub does when a participant queue is full: block, drop or disconnect")
 	exitAfter        = flag.Duration("exit-after", 0, "tells the application to terminate automatically after the given duration (ex.: 1h30m)")
 )
 
@@ -38,14 +76,85 @@ func main() {
 		fmt.Fprintf(os.Stderr, `Usage of hub:
 
 Run central websocket hub as follow. Certificate for provided domain automatically 
-requested from Let's Encrypt unless argument -dev is used.
+requested from Let's Encrypt unless argument -dev or -cert is used.
 
-	hub -domain www.mydomain.io -token "secret"
+	hub -domain www.mydomain.io -token "secret" -admin-token "admin secret"
+
+Add -http-listen when Let's Encrypt must validate the domain over plain http, behind
+load balancers terminating TLS-ALPN. Other http requests are redirected to https.
+
+	hub -domain www.mydomain.io -token "secret" -http-listen :http
+
+Run the hub with certificate files, reloaded when renewed.
+
+	hub -token "secret" -cert hub.pem -key hub-key.pem
 	
+Query the hub admin API to list rooms and participants.
+
+	curl -H "x-token: admin secret" https://www.mydomain.io/hub/rooms
+
+Run the hub requiring agents and clients to present a certificate signed by an internal CA.
+
+	hub -domain www.mydomain.io -token "secret" -client-ca clients-ca.pem
+
+Run agents and clients with a client certificate and an internal CA, or pinning the hub certificate.
+
+	hub -agent wss://hub.internal/hub -token "secret" -ca-file internal-ca.pem -client-cert agent.pem -client-key agent-key.pem
+	hub -client wss://hub.internal/hub -token "secret" -pin 3f:a1:...:9c -client-cert client.pem -client-key client-key.pem -tunnel 192.168.2.4:3389
+
 Run agent instance to run command on behalf of client.
 
 	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password"
 	
+Run agent instance restricting the destinations clients may reach.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -policy policy.json
+
+Policy JSON file looks like (first matching rule applies, Default applies otherwise):
+{
+	"Default": "deny",
+	"Rules": [{
+		"Action": "deny",
+		"Hosts": ["192.168.2.1", "*.admin.mycompany.net"]
+	}, {
+		"Action": "allow",
+		"Hosts": ["192.168.2.0/24", "server1.lab.mycompany.net"],
+		"Ports": "22,3389,8000-8999"
+	}],
+	"ListenDefault": "deny",
+	"Listen": [{
+		"Action": "allow",
+		"Hosts": ["127.0.0.1"],
+		"Ports": "9000-9099"
+	}]
+}
+
+Listen rules and ListenDefault apply to the addresses reverse tunnels make the agent listen on.
+With a policy file, reverse tunnels are denied unless Listen rules or ListenDefault allow them.
+Without a policy file, reverse tunnels may only listen on loopback addresses.
+
+Run agent instance allowing clients to run some programs.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -allow-exec uptime,systemctl
+
+Run agent instance giving clients an interactive shell, for hosts without ssh server.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -allow-shell
+
+Run agent instance letting clients put and get files in a directory.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -allow-files /srv/transfer
+
+Run two agents of the same site in one room, and a client using the least loaded of them.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -agent-name lab-a -agent-labels site=lab
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -agent-name lab-b -agent-labels site=lab
+	hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -agent-labels site=lab -agent-select least-loaded -tunnel 192.168.2.4:3389
+
+Add -e2e-key to agent and clients so the hub only relays encrypted messages.
+
+	hub -agent wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -e2e-key "e2e secret"
+
 Run a client to tunnel tcp/ip traffic over. Client listens on -listen
 
     hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -tunnel 192.168.2.4:3389 -listen 127.0.0.1:8888
@@ -54,13 +163,60 @@ Run a client to tunnel tcp/ip RDP traffic over. Will start mstsc.exe.
 
     hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -rdp 192.168.2.4
 
+Run a client as a local SOCKS5 proxy reaching any host behind the agent.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -socks5 127.0.0.1:1080
+
+Run a client as a local HTTP proxy, for tools honoring HTTP_PROXY and HTTPS_PROXY.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -http-proxy 127.0.0.1:3128
+
+Run a command on the agent. Quote arguments holding spaces. No shell is involved.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -exec "systemctl status 'my service'"
+
+Open an interactive shell on the agent host.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -shell
+
+Push a build to the agent and pull a log from it. Paths on the agent are relative to its
+-allow-files directory. Running an interrupted transfer again resumes it.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -put build.zip builds/build.zip
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -get logs/app.log app.log
+
+Run a long-lived client managed through its local control API, listing tunnels with their
+connections and byte counters, adding and removing tunnels at runtime.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -control 127.0.0.1:7000 -control-token "control secret"
+    curl -H "x-token: control secret" http://127.0.0.1:7000/tunnels
+    curl -H "x-token: control secret" -H "Content-Type: application/json" -d '{"Listen":"127.0.0.1:8888","Destination":"192.168.2.4:3389"}' http://127.0.0.1:7000/tunnels
+    curl -H "x-token: control secret" -X DELETE http://127.0.0.1:7000/tunnels/1
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -control unix:/run/user/1000/hub.sock
+    curl --unix-socket /run/user/1000/hub.sock http://localhost/tunnels
+
+Run a client to tunnel udp datagrams, one udp flow per source address.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -udp -tunnel 192.168.2.53:53 -listen 127.0.0.1:5353
+
+Run a client asking the agent to listen on port 9000 and to relay connections back to a service on the client computer.
+The agent policy must allow listening on 0.0.0.0:9000.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -reverse 0.0.0.0:9000 -tunnel 127.0.0.1:3000
+
+Run a client carrying all tunnel connections over one multiplexed websocket.
+
+    hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -tunnels tunnels.json -mux
+
 Run a client to tunnel multiple tcp/ip connections traffic over from many ports.
 
 	hub -client wss://www.mydomain.io/hub -token "secret" -room "room" -password "password" -tunnels tunnels.json
 	
-JSON file looks like:
+JSON file looks like the following. ModifyHostsFile needs admin rights. Reverse tunnels listen on
+the agent and relay connections to a Destination reachable from the client.
 {
-	"ModifyHostsFile":true, // need admin rights
+	"ModifyHostsFile":true,
 	"Tunnels":[{
 		"Listen":"127.0.0.2:3389",
 		"Destination": "server1.lab.mycompany.net:3389"
@@ -70,6 +226,14 @@ JSON file looks like:
 	}, {
 		"Listen":"127.0.0.3:443",
 		"Destination": "server2.lab.mycompany.net:443"
+	}, {
+		"Listen":"127.0.0.2:514",
+		"Destination": "syslog.lab.mycompany.net:514",
+		"UDP": true
+	}, {
+		"Listen":"0.0.0.0:9000",
+		"Destination": "127.0.0.1:3000",
+		"Reverse": true
 	}]
 }
 `)
@@ -79,6 +243,10 @@ JSON file looks like:
 	flag.Parse()
 	setupCloseHandler()
 
+	if *udpTimeout < time.Second {
+		log.Fatal("-udp-timeout must be at least 1s")
+	}
+
 	if *exitAfter != 0 {
 		go func() {
 			<-time.After(*exitAfter)
@@ -92,14 +260,43 @@ JSON file looks like:
 		return
 	}
 	if len(*client) > 0 {
-		startClient()
+		startClient(clientOptionsFromFlags())
 		return
 	}
 	startServer()
 }
 
+// clientOptionsFromFlags returns the client settings given on the command line.
+func clientOptionsFromFlags() clientOptions {
+	return clientOptions{
+		hub:              *client,
+		agentName:        *agentName,
+		agentLabels:      *agentLabels,
+		agentSelect:      *agentSelect,
+		agentTimeout:     *agentTimeout,
+		resumeTimeout:    *resumeTimeout,
+		udpTimeout:       *udpTimeout,
+		exitOnDisconnect: *exitOnDisconnect,
+		listen:           *listen,
+		tunnel:           *tunnel,
+		reverse:          *reverse,
+		udp:              *udp,
+		rdp:              *rdp,
+		tunnelsFile:      *tunnelsFile,
+		socks5:           *socks5,
+		httpProxy:        *httpProxy,
+		multiplex:        *multiplex,
+		controlAPI:       *controlAPI,
+		controlToken:     *controlToken,
+		execCommand:      *execCommand,
+		shell:            *shell,
+		putFile:          *putFile,
+		getFile:          *getFile,
+		args:             flag.Args()}
+}
+
 func setupCloseHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -110,24 +307,98 @@ func setupCloseHandler() {
 
 func startServer() {
 	_ = os.Mkdir("./webapps", os.ModeDir)
-	http.Handle("/", http.FileServer(http.Dir("./webapps")))
-	http.HandleFunc("/hub", hublib.NewHubHandlerFunc(*token))
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("./webapps")))
+	overflowPolicy, err := hublib.ParseOverflowPolicy(*overflow)
+	if err != nil {
+		log.Fatal("hub   | ", err)
+	}
+	if len(*clientCA) > 0 && *dev {
+		log.Fatal("hub   | -client-ca requires TLS and cannot be used with -dev")
+	}
+	if len(*httpListen) > 0 && (*dev || len(*certFile) > 0) {
+		log.Fatal("hub   | -http-listen is only used with Let's Encrypt certificates and cannot be used with -dev or -cert")
+	}
+	hub := hublib.NewHub(hublib.HubOptions{
+		Token:             *token,
+		AdminToken:        *adminToken,
+		QueueSize:         *queueSize,
+		Overflow:          overflowPolicy,
+		RequireClientCert: len(*clientCA) > 0,
+	})
+	mux.Handle("/hub", hub)
+	if len(*adminToken) > 0 {
+		mux.HandleFunc("/hub/rooms", hub.ServeAdmin)
+	}
+	atexit.Register(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
 	if !*dev {
-		_ = os.Mkdir("./secret-dir", os.ModeDir)
-		m := &autocert.Manager{
-			Cache:      autocert.DirCache("./secret-dir"),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*domain),
-		}
 		s := &http.Server{
-			Addr:      *listen,
-			TLSConfig: m.TLSConfig(),
+			Addr:    *listen,
+			Handler: mux,
+		}
+		if len(*certFile) > 0 {
+			reloader, err := hublib.NewCertReloader(*certFile, *keyFile)
+			if err != nil {
+				log.Fatal("hub   | failed to load certificate. ", err)
+			}
+			s.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		} else {
+			_ = os.Mkdir("./secret-dir", os.ModeDir)
+			m := &autocert.Manager{
+				Cache:      autocert.DirCache("./secret-dir"),
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(*domain),
+			}
+			s.TLSConfig = m.TLSConfig()
+			if len(*httpListen) > 0 {
+				go func() {
+					log.Println("hub   | answering HTTP-01 challenges on", *httpListen)
+					err := http.ListenAndServe(*httpListen, m.HTTPHandler(nil))
+					log.Fatal("hub   | http listener failed. ", err)
+				}()
+			}
+		}
+		if len(*clientCA) > 0 {
+			err = hublib.ServerTLSConfig(s.TLSConfig, *clientCA)
+			if err != nil {
+				log.Fatal("hub   | failed to load client CA certificates. ", err)
+			}
 		}
 		s.ListenAndServeTLS("", "")
 	} else {
 		s := &http.Server{
-			Addr: *listen,
+			Addr:    *listen,
+			Handler: mux,
 		}
 		s.ListenAndServe()
 	}
 }
+
+// newHubClient creates the client used by agent and client modes to reach
+// hubUrl with the proxy and TLS settings given on the command line.
+func newHubClient(hubUrl string) *hublib.Client {
+	opts := hublib.ClientOptions{Token: *token, BypassProxy: *bypassProxy}
+	if len(*proxy) > 0 {
+		u, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatal("failed to parse proxy URL. ", err)
+		}
+		opts.Proxy = http.ProxyURL(u)
+	}
+	if len(*caFile) > 0 || len(*pins) > 0 || len(*clientCert) > 0 {
+		var pinList []string
+		if len(*pins) > 0 {
+			pinList = strings.Split(*pins, ",")
+		}
+		tlsConfig, err := hublib.ClientTLSConfig(*caFile, *clientCert, *clientKey, pinList)
+		if err != nil {
+			log.Fatal("failed to configure TLS. ", err)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return hublib.NewClientWithOptions(hubUrl, opts)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// policyRule allows or denies destinations matching any of its Hosts on any of its Ports.
+type policyRule struct {
+	Action string   // "allow" or "deny"
+	Hosts  []string // CIDRs, IP addresses, host names or *.domain patterns. Empty matches any host
+	Ports  string   // comma separated ports and port ranges like "22,8000-9000". Empty matches any port
+}
+
+// agentPolicyConfig is the JSON policy file given to the agent with -policy.
+// Rules are evaluated in order and the first matching rule applies.
+// Default applies when no rule matches and is "deny" unless set to "allow".
+// Listen rules and ListenDefault apply the same way to the addresses reverse
+// tunnels make the agent listen on.
+type agentPolicyConfig struct {
+	Default       string
+	Rules         []policyRule
+	ListenDefault string
+	Listen        []policyRule
+}
+
+type portRange struct {
+	from, to int
+}
+
+type compiledRule struct {
+	allow bool
+	nets  []*net.IPNet
+	names []string
+	ports []portRange
+}
+
+type destinationPolicy struct {
+	kind         string // "destination" or "listen address", in messages
+	ruleName     string // "rule" or "listen rule", in messages
+	defaultAllow bool
+	rules        []compiledRule
+	needsLookup  bool                                // some rule matches on addresses so host names are resolved
+	lookupIP     func(host string) ([]net.IP, error) // net.LookupIP unless replaced by tests
+	listen       *destinationPolicy                  // listen rules, nil for the listen rules themselves
+}
+
+// agentPolicy is nil when the agent accepts every destination.
+var agentPolicy *destinationPolicy
+
+func loadPolicy(filename string) (*destinationPolicy, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg agentPolicyConfig
+	err = json.Unmarshal(dat, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return compilePolicy(cfg)
+}
+
+func compilePolicy(cfg agentPolicyConfig) (*destinationPolicy, error) {
+	policy, err := compileRules(cfg.Default, cfg.Rules, "destination", "rule")
+	if err != nil {
+		return nil, err
+	}
+	policy.listen, err = compileRules(cfg.ListenDefault, cfg.Listen, "listen address", "listen rule")
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func compileRules(defaultAction string, rules []policyRule, kind, ruleName string) (*destinationPolicy, error) {
+	policy := &destinationPolicy{kind: kind, ruleName: ruleName, lookupIP: net.LookupIP}
+	switch strings.ToLower(defaultAction) {
+	case "allow":
+		policy.defaultAllow = true
+	case "deny", "":
+	default:
+		return nil, fmt.Errorf("invalid default action %q", defaultAction)
+	}
+	for i, rule := range rules {
+		var cr compiledRule
+		switch strings.ToLower(rule.Action) {
+		case "allow":
+			cr.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("%s #%d: invalid action %q", ruleName, i+1, rule.Action)
+		}
+		for _, host := range rule.Hosts {
+			if strings.Contains(host, "/") {
+				_, ipNet, err := net.ParseCIDR(host)
+				if err != nil {
+					return nil, fmt.Errorf("%s #%d: %s", ruleName, i+1, err)
+				}
+				cr.nets = append(cr.nets, ipNet)
+			} else if ip := net.ParseIP(host); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				cr.nets = append(cr.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			} else {
+				cr.names = append(cr.names, strings.ToLower(host))
+			}
+		}
+		if len(cr.nets) > 0 {
+			policy.needsLookup = true
+		}
+		ports, err := parsePorts(rule.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("%s #%d: %s", ruleName, i+1, err)
+		}
+		cr.ports = ports
+		policy.rules = append(policy.rules, cr)
+	}
+	return policy, nil
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		bounds := strings.SplitN(field, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid port range %q", field)
+			}
+		}
+		ports = append(ports, portRange{from, to})
+	}
+	return ports, nil
+}
+
+// Check returns an error telling why destination (host:port) is denied.
+// When allowed, it returns the addresses it checked, which must be dialed
+// instead of resolving the host name again: the name could resolve to a
+// denied address by then. No address is returned when the host name only
+// had to match name rules.
+func (policy *destinationPolicy) Check(destination string) ([]net.IP, error) {
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s", policy.kind, destination)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s port %s", policy.kind, portStr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if policy.needsLookup {
+		// host names are resolved so address rules also apply to them
+		ips, err = policy.lookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("%s %s not allowed by agent policy. Failed to resolve %s", policy.kind, destination, host)
+		}
+	}
+	for i, rule := range policy.rules {
+		if rule.matches(host, ips, port) {
+			if rule.allow {
+				return ips, nil
+			}
+			return nil, fmt.Errorf("%s %s denied by agent policy %s #%d", policy.kind, destination, policy.ruleName, i+1)
+		}
+	}
+	if policy.defaultAllow {
+		return ips, nil
+	}
+	return nil, fmt.Errorf("%s %s not allowed by agent policy", policy.kind, destination)
+}
+
+// CheckListen returns an error telling why a reverse tunnel may not make the
+// agent listen on listenIf (host:port). When allowed, it returns the address
+// to listen on. An empty host means all interfaces and matches 0.0.0.0.
+func (policy *destinationPolicy) CheckListen(listenIf string) (string, error) {
+	host, port, err := net.SplitHostPort(listenIf)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %s", listenIf)
+	}
+	if len(host) == 0 {
+		host = "0.0.0.0"
+	}
+	ips, err := policy.listen.Check(net.JoinHostPort(host, port))
+	if err != nil {
+		return "", err
+	}
+	if len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port), nil
+	}
+	return listenIf, nil
+}
+
+// checkDestination applies the agent policy, if any, to destination and
+// returns the addresses to give to dialDestination.
+func checkDestination(destination string) ([]net.IP, error) {
+	if agentPolicy == nil {
+		return nil, nil
+	}
+	return agentPolicy.Check(destination)
+}
+
+// checkListen applies the agent policy to the address a reverse tunnel asks
+// the agent to listen on and returns the address to listen on. Without a
+// policy, only loopback addresses are allowed so reverse tunnels are not
+// reachable from the network unless a policy says so.
+func checkListen(listenIf string) (string, error) {
+	if agentPolicy != nil {
+		return agentPolicy.CheckListen(listenIf)
+	}
+	host, _, err := net.SplitHostPort(listenIf)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %s", listenIf)
+	}
+	if !isLoopbackHost(host) {
+		return "", fmt.Errorf("listen address %s is not a loopback address and no agent policy allows it", listenIf)
+	}
+	return listenIf, nil
+}
+
+// dialDestination connects to destination (host:port) through one of ips,
+// the addresses vetted by the agent policy. The host name is only resolved
+// when ips is empty.
+func dialDestination(network, destination string, ips []net.IP) (net.Conn, error) {
+	if len(ips) == 0 {
+		return net.Dial(network, destination)
+	}
+	_, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (rule *compiledRule) matches(host string, ips []net.IP, port int) bool {
+	if len(rule.ports) > 0 {
+		found := false
+		for _, r := range rule.ports {
+			if port >= r.from && port <= r.to {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.nets) == 0 && len(rule.names) == 0 {
+		return true
+	}
+	for _, name := range rule.names {
+		if name == host || (strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:])) {
+			return true
+		}
+	}
+	if len(rule.nets) == 0 || len(ips) == 0 {
+		return false
+	}
+	// a deny rule matches when any address of the host is denied, an allow
+	// rule only when all of them are allowed
+	contained := 0
+	for _, ip := range ips {
+		for _, ipNet := range rule.nets {
+			if ipNet.Contains(ip) {
+				contained++
+				break
+			}
+		}
+	}
+	if rule.allow {
+		return contained == len(ips)
+	}
+	return contained > 0
+}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startPTY starts cmd as the session leader of a new pseudo-terminal of the
+// given size and returns the master side of the terminal.
+func startPTY(cmd *exec.Cmd, rows, cols int) (*os.File, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pseudo-terminal. %s", err)
+	}
+	// a non blocking master lets Close interrupt pending reads
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pseudo-terminal. %s", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pseudo-terminal name. %s", err)
+	}
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open pseudo-terminal. %s", err)
+	}
+	defer tty.Close()
+	if err = resizePTY(master, rows, cols); err != nil {
+		master.Close()
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err = cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// resizePTY sets the window size of the pseudo-terminal of master.
+func resizePTY(master *os.File, rows, cols int) error {
+	rc, err := master.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rc.Control(func(fd uintptr) {
+		err = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: uint16(rows), Col: uint16(cols)})
+	})
+	return err
+}
+
+// killPTY kills the process group of a shell started by startPTY and the
+// foreground process group of its terminal, which job control gives to the
+// command the shell is running.
+func killPTY(cmd *exec.Cmd, master *os.File) {
+	pgrp := 0
+	if rc, err := master.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			pgrp, _ = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+		})
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if pgrp > 1 && pgrp != cmd.Process.Pid {
+		syscall.Kill(-pgrp, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errNoPTY = errors.New("remote shells are only supported by linux agents")
+
+func startPTY(cmd *exec.Cmd, rows, cols int) (*os.File, error) {
+	return nil, errNoPTY
+}
+
+func resizePTY(master *os.File, rows, cols int) error {
+	return errNoPTY
+}
+
+func killPTY(cmd *exec.Cmd, master *os.File) {
+	cmd.Process.Kill()
+}
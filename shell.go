@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dhx71/hub/hublib"
+	"github.com/google/uuid"
+)
+
+// Remote shells run in a room of their own. Once the client joined it and
+// sent startShell with its terminal size, both sides exchange frames made
+// of a type byte, a 4 bytes payload length and the payload. Frames are used
+// instead of JSON messages to keep terminal data out of the logs.
+const (
+	shellData   byte = iota // terminal input or output
+	shellResize             // new terminal size: rows and columns as 2 bytes each
+	shellExit               // shell exit code as 4 bytes
+)
+
+// shellConn reads and writes shell frames on a room.
+type shellConn struct {
+	conn   *hublib.RoomConn
+	reader *bufio.Reader
+	lock   sync.Mutex // serializes frame writes
+}
+
+func newShellConn(room *hublib.Room) *shellConn {
+	conn := hublib.NewRoomConn(room)
+	return &shellConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (sc *shellConn) write(frameType byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	_, err := sc.conn.Write(frame)
+	return err
+}
+
+func (sc *shellConn) read() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(sc.reader, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(sc.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// createShell starts a login shell under a pseudo-terminal and relays it
+// through a new shell room.
+func createShell(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, refid, peerPublic string) {
+	if !*allowShell {
+		log.Println("agent | refusing to start shell. Remote shells are disabled")
+		controlRoom.WriteJSON(agentResponse{
+			Type:  "shellCreationFailed",
+			Refid: refid,
+			Cause: "remote shells are disabled on agent"})
+		return
+	}
+	shellRoom := uuid.New().String()
+	shellPassword := uuid.New().String()
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, shellRoom, shellPassword, kp, peerPublic, false)
+	if err != nil {
+		log.Println("agent |", shellRoom, "failed to create room for shell", err)
+		controlRoom.WriteJSON(agentResponse{
+			Type:  "shellCreationFailed",
+			Refid: refid,
+			Cause: "failed to create room for shell"})
+		return
+	}
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "shellCreated",
+		Refid:     refid,
+		Room:      shellRoom,
+		Password:  shellPassword,
+		Success:   true,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", shellRoom, "Failed to send shellCreated message to client")
+		roomConn.Close()
+		return
+	}
+
+	timer := time.AfterFunc(30*time.Second, func() { roomConn.Close() })
+	var start agentRequest
+	err = roomConn.ReadJSON(&start)
+	timer.Stop()
+	if err != nil || start.Type != "startShell" {
+		log.Println("agent |", shellRoom, "client did not start shell.", err)
+		roomConn.Close()
+		return
+	}
+	sc := newShellConn(roomConn)
+	defer sc.conn.Close()
+	defer trackTunnel()()
+
+	shell := os.Getenv("SHELL")
+	if len(shell) == 0 {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	// a leading dash makes it a login shell
+	cmd.Args[0] = "-" + filepath.Base(shell)
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+	cmd.Env = os.Environ()
+	if len(start.Term) > 0 {
+		cmd.Env = append(cmd.Env, "TERM="+start.Term)
+	}
+	master, err := startPTY(cmd, start.Rows, start.Cols)
+	if err != nil {
+		log.Println("agent |", shellRoom, "failed to start shell", shell, err)
+		sc.write(shellData, []byte(fmt.Sprintf("failed to start shell. %s\r\n", err)))
+		sc.write(shellExit, exitCodePayload(-1))
+		return
+	}
+	log.Println("agent |", shellRoom, "started shell", shell)
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 4096)
+		for {
+			n, err := master.Read(buf)
+			if n > 0 {
+				if sc.write(shellData, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			frameType, payload, err := sc.read()
+			if err != nil {
+				// client is gone
+				killPTY(cmd, master)
+				return
+			}
+			switch frameType {
+			case shellData:
+				master.Write(payload)
+			case shellResize:
+				if len(payload) == 4 {
+					resizePTY(master, int(binary.BigEndian.Uint16(payload)), int(binary.BigEndian.Uint16(payload[2:])))
+				}
+			}
+		}
+	}()
+
+	cmd.Wait()
+	// background jobs may keep the terminal open
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second):
+	}
+	master.Close()
+	<-outputDone
+	code := cmd.ProcessState.ExitCode()
+	log.Println("agent |", shellRoom, "shell exited with code", code)
+	sc.write(shellExit, exitCodePayload(code))
+}
+
+func exitCodePayload(code int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(int32(code)))
+	return payload
+}
+
+// runRemoteShell starts a shell on an agent, waiting up to timeout for its
+// answer, and relays it with stdin and stdout until it exits. size returns the
+// terminal rows and columns and is called again each time resized is
+// signaled. It returns the shell exit code.
+func runRemoteShell(hubClient *hublib.Client, dispatcher *controlDispatcher, timeout time.Duration, term string, stdin io.Reader, stdout io.Writer, size func() (int, int), resized <-chan struct{}) (int, error) {
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{
+		Type:      "createShell",
+		PublicKey: publicKey(kp)}, timeout)
+	if err != nil {
+		return -1, err
+	}
+	if resp.Type != "shellCreated" {
+		return -1, fmt.Errorf("agent refused to start shell. cause: %s", resp.Cause)
+	}
+	shellRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		return -1, fmt.Errorf("failed to join shell room. %s", err)
+	}
+	rows, cols := size()
+	err = shellRoom.WriteJSON(agentRequest{Type: "startShell", Refid: resp.Refid, Rows: rows, Cols: cols, Term: term})
+	if err != nil {
+		shellRoom.Close()
+		return -1, fmt.Errorf("failed to start shell. %s", err)
+	}
+	sc := newShellConn(shellRoom)
+	defer sc.conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if sc.write(shellData, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-resized:
+				rows, cols := size()
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint16(payload, uint16(rows))
+				binary.BigEndian.PutUint16(payload[2:], uint16(cols))
+				sc.write(shellResize, payload)
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		frameType, payload, err := sc.read()
+		if err != nil {
+			return -1, fmt.Errorf("lost connection to shell. %s", err)
+		}
+		switch frameType {
+		case shellData:
+			stdout.Write(payload)
+		case shellExit:
+			if len(payload) == 4 {
+				return int(int32(binary.BigEndian.Uint32(payload))), nil
+			}
+			return -1, nil
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhx71/hub/hublib"
+	"github.com/google/uuid"
+)
+
+// Files are transferred through a room of their own once the agent answered
+// a put or get request. The receiving side writes to a .part file and
+// resumes from its size when the transfer is requested again. The file is
+// renamed once its SHA-256 checksum matches the one of the sender.
+
+// transferIdleTimeout is how long a transfer waits for its peer.
+const transferIdleTimeout = time.Minute
+
+// idleReader reads from a RoomConn, failing when no data comes for transferIdleTimeout.
+type idleReader struct {
+	conn *hublib.RoomConn
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+	return r.conn.Read(p)
+}
+
+// fileChecksum returns the hex SHA-256 checksum of the named file.
+func fileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openPartFile opens name for writing at offset, dropping anything after it.
+func openPartFile(name string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(offset); err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// partSize returns the size of the partially transferred file name, 0 when
+// there is none or when it is larger than size.
+func partSize(name string, size int64) int64 {
+	fi, err := os.Stat(name)
+	if err != nil || fi.Size() > size {
+		return 0
+	}
+	return fi.Size()
+}
+
+// resolveAgentPath maps a path given by a client into the -allow-files
+// directory. Clients cannot reach files outside of it: the directory itself
+// and paths going through a symbolic link are refused.
+func resolveAgentPath(p string) (string, error) {
+	if len(*allowFiles) == 0 {
+		return "", fmt.Errorf("file transfers are disabled on agent")
+	}
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid file path %q", p)
+	}
+	target := filepath.Join(*allowFiles, filepath.FromSlash(clean))
+	rel, err := filepath.Rel(*allowFiles, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file path %q", p)
+	}
+	name := *allowFiles
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		name = filepath.Join(name, elem)
+		if err = refuseSymlink(name); err != nil {
+			return "", fmt.Errorf("invalid file path %q. %s", p, err)
+		}
+	}
+	return target, nil
+}
+
+// refuseSymlink fails when name is a symbolic link. A missing name is fine.
+func refuseSymlink(name string) error {
+	fi, err := os.Lstat(name)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symbolic link", filepath.Base(name))
+	}
+	return nil
+}
+
+// receiveFile writes the file a client puts to the agent.
+func receiveFile(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, req agentRequest) {
+	returnFailure := func(cause string) {
+		controlRoom.WriteJSON(agentResponse{
+			Type:  "transferFailed",
+			Refid: req.Refid,
+			Cause: cause})
+	}
+	target, err := resolveAgentPath(req.Path)
+	if err != nil {
+		log.Println("agent | refusing to receive file", req.Path, err)
+		returnFailure(err.Error())
+		return
+	}
+	part := target + ".part"
+	if err = refuseSymlink(part); err != nil {
+		log.Println("agent | refusing to receive file", req.Path, err)
+		returnFailure(err.Error())
+		return
+	}
+	offset := partSize(part, req.Size)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	var f *os.File
+	if err == nil {
+		f, err = openPartFile(part, offset)
+	}
+	if err != nil {
+		log.Println("agent | failed to create file", part, err)
+		returnFailure("failed to create file " + req.Path)
+		return
+	}
+	defer f.Close()
+	transferRoom := uuid.New().String()
+	transferPassword := uuid.New().String()
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, transferRoom, transferPassword, kp, req.PublicKey, false)
+	if err != nil {
+		log.Println("agent |", transferRoom, "failed to create room for transfer", err)
+		returnFailure("failed to create room for transfer")
+		return
+	}
+	conn := hublib.NewRoomConn(roomConn)
+	defer conn.Close()
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "transferRoomCreated",
+		Refid:     req.Refid,
+		Room:      transferRoom,
+		Password:  transferPassword,
+		Success:   true,
+		Offset:    offset,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", transferRoom, "Failed to send transferRoomCreated message to client")
+		return
+	}
+	defer trackTunnel()()
+
+	log.Println("agent |", transferRoom, "receiving", target, "from offset", offset)
+	_, err = io.CopyN(f, idleReader{conn}, req.Size-offset)
+	f.Close()
+	if err != nil {
+		log.Println("agent |", transferRoom, "transfer of", target, "interrupted.", err)
+		return
+	}
+	verdict := agentResponse{Type: "transferDone", Refid: req.Refid, Success: true}
+	sum, err := fileChecksum(part)
+	if err == nil && sum != req.Checksum {
+		os.Remove(part)
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err == nil {
+		err = os.Rename(part, target)
+	}
+	if err != nil {
+		log.Println("agent |", transferRoom, "failed to receive", target, err)
+		verdict = agentResponse{Type: "transferFailed", Refid: req.Refid, Cause: err.Error()}
+	} else {
+		log.Println("agent |", transferRoom, "received", target)
+	}
+	json.NewEncoder(conn).Encode(verdict)
+}
+
+// sendFile sends a file of the agent to the client getting it.
+func sendFile(hubClient *hublib.Client, controlRoom *hublib.ResilientRoom, req agentRequest) {
+	returnFailure := func(cause string) {
+		controlRoom.WriteJSON(agentResponse{
+			Type:  "transferFailed",
+			Refid: req.Refid,
+			Cause: cause})
+	}
+	source, err := resolveAgentPath(req.Path)
+	if err != nil {
+		log.Println("agent | refusing to send file", req.Path, err)
+		returnFailure(err.Error())
+		return
+	}
+	f, err := os.Open(source)
+	var fi os.FileInfo
+	if err == nil {
+		defer f.Close()
+		fi, err = f.Stat()
+	}
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s is a directory", req.Path)
+	}
+	var sum string
+	if err == nil {
+		sum, err = fileChecksum(source)
+	}
+	if err != nil {
+		log.Println("agent | failed to read file", source, err)
+		returnFailure("failed to read file " + req.Path)
+		return
+	}
+	offset := req.Offset
+	if offset < 0 || offset > fi.Size() {
+		offset = 0
+	}
+	transferRoom := uuid.New().String()
+	transferPassword := uuid.New().String()
+	kp := newE2EKeyPair()
+	roomConn, err := joinTunnelRoom(hubClient, transferRoom, transferPassword, kp, req.PublicKey, false)
+	if err != nil {
+		log.Println("agent |", transferRoom, "failed to create room for transfer", err)
+		returnFailure("failed to create room for transfer")
+		return
+	}
+	err = controlRoom.WriteJSON(agentResponse{
+		Type:      "transferRoomCreated",
+		Refid:     req.Refid,
+		Room:      transferRoom,
+		Password:  transferPassword,
+		Success:   true,
+		Size:      fi.Size(),
+		Offset:    offset,
+		Checksum:  sum,
+		PublicKey: publicKey(kp)})
+	if err != nil {
+		log.Println("agent |", transferRoom, "Failed to send transferRoomCreated message to client")
+		roomConn.Close()
+		return
+	}
+	// data is only sent once the client is in the room
+	timer := time.AfterFunc(30*time.Second, func() { roomConn.Close() })
+	var start agentRequest
+	err = roomConn.ReadJSON(&start)
+	timer.Stop()
+	if err != nil || start.Type != "startTransfer" {
+		log.Println("agent |", transferRoom, "client did not start transfer.", err)
+		roomConn.Close()
+		return
+	}
+	defer trackTunnel()()
+	conn := hublib.NewRoomConn(roomConn)
+	defer conn.Close()
+	log.Println("agent |", transferRoom, "sending", source, "from offset", offset)
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		_, err = io.CopyN(conn, f, fi.Size()-offset)
+	}
+	if err != nil {
+		log.Println("agent |", transferRoom, "transfer of", source, "interrupted.", err)
+	}
+}
+
+// putRemoteFile sends the local file to remote on the agent, resuming a
+// previous transfer interrupted before completion. The agent has timeout to
+// answer the request.
+func putRemoteFile(hubClient *hublib.Client, dispatcher *controlDispatcher, timeout time.Duration, local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := fileChecksum(local)
+	if err != nil {
+		return err
+	}
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{
+		Type:      "put",
+		Path:      remote,
+		Size:      fi.Size(),
+		Checksum:  sum,
+		PublicKey: publicKey(kp)}, timeout)
+	if err != nil {
+		return err
+	}
+	if resp.Type != "transferRoomCreated" {
+		return fmt.Errorf("agent refused to receive %s. cause: %s", remote, resp.Cause)
+	}
+	transferRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		return fmt.Errorf("failed to join transfer room. %s", err)
+	}
+	conn := hublib.NewRoomConn(transferRoom)
+	defer conn.Close()
+	if resp.Offset > 0 {
+		log.Println("client| resuming transfer of", local, "at offset", resp.Offset)
+	}
+	if _, err = f.Seek(resp.Offset, io.SeekStart); err == nil {
+		_, err = io.CopyN(conn, f, fi.Size()-resp.Offset)
+	}
+	if err != nil {
+		return fmt.Errorf("transfer of %s interrupted. Run again to resume. %s", local, err)
+	}
+	var verdict agentResponse
+	err = json.NewDecoder(idleReader{conn}).Decode(&verdict)
+	if err != nil {
+		return fmt.Errorf("agent did not confirm the transfer of %s. Run again to resume. %s", local, err)
+	}
+	if verdict.Type != "transferDone" {
+		return fmt.Errorf("agent failed to receive %s. cause: %s", remote, verdict.Cause)
+	}
+	return nil
+}
+
+// getRemoteFile fetches remote from the agent into the local file, resuming
+// a previous transfer interrupted before completion. The agent has timeout to
+// answer the request.
+func getRemoteFile(hubClient *hublib.Client, dispatcher *controlDispatcher, timeout time.Duration, remote, local string) error {
+	part := local + ".part"
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+	kp := newE2EKeyPair()
+	resp, err := dispatcher.request(agentRequest{
+		Type:      "get",
+		Path:      remote,
+		Offset:    offset,
+		PublicKey: publicKey(kp)}, timeout)
+	if err != nil {
+		return err
+	}
+	if resp.Type != "transferRoomCreated" {
+		return fmt.Errorf("agent refused to send %s. cause: %s", remote, resp.Cause)
+	}
+	f, err := openPartFile(part, resp.Offset)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	transferRoom, err := joinTunnelRoom(hubClient, resp.Room, resp.Password, kp, resp.PublicKey, true)
+	if err != nil {
+		return fmt.Errorf("failed to join transfer room. %s", err)
+	}
+	err = transferRoom.WriteJSON(agentRequest{Type: "startTransfer", Refid: resp.Refid})
+	if err != nil {
+		transferRoom.Close()
+		return fmt.Errorf("failed to start transfer. %s", err)
+	}
+	conn := hublib.NewRoomConn(transferRoom)
+	defer conn.Close()
+	if resp.Offset > 0 {
+		log.Println("client| resuming transfer of", remote, "at offset", resp.Offset)
+	}
+	_, err = io.CopyN(f, idleReader{conn}, resp.Size-resp.Offset)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("transfer of %s interrupted. Run again to resume. %s", remote, err)
+	}
+	sum, err := fileChecksum(part)
+	if err != nil {
+		return err
+	}
+	if sum != resp.Checksum {
+		os.Remove(part)
+		return fmt.Errorf("checksum of %s does not match the one of the agent", local)
+	}
+	return os.Rename(part, local)
+}